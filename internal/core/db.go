@@ -53,10 +53,15 @@ func NewDB(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{
-		Path: path,
-		kv:   *kv,
-	}, nil
+	db := NewDBFromKV(kv)
+	db.Path = path
+	return db, nil
+}
+
+// NewDBFromKV returns a database on top of an opened kv, for example one
+// from storage.NewMemKV
+func NewDBFromKV(kv *storage.KV) *DB {
+	return &DB{kv: *kv}
 }
 
 func (db *DB) getTableDef(name string) (*TableDef, error) {
@@ -113,7 +118,8 @@ func (db *DB) scan(tdef *TableDef) ([]Record, error) {
 	end[len(end)-1] -= 1
 
 	result := []Record{}
-	for k, v := range db.kv.Scan(key, end) {
+	scanner := db.kv.NewScanner(key, end)
+	for k, v := range scanner.All() {
 
 		current := NewRecord()
 		err := tdef.DecodeValuesToRecord(v, &current)
@@ -129,6 +135,9 @@ func (db *DB) scan(tdef *TableDef) ([]Record, error) {
 		result = append(result, current)
 
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
@@ -145,6 +154,23 @@ func (db *DB) insert(tdef *TableDef, rec *Record) error {
 	return err
 }
 
+// insertAll writes all records with a single commit
+func (db *DB) insertAll(tdef *TableDef, recs []Record) error {
+	batch := storage.WriteBatch{}
+	for _, rec := range recs {
+		key, err := tdef.EncodeKey(rec)
+		if err != nil {
+			return err
+		}
+		val, err := tdef.EncodeValue(rec)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, val)
+	}
+	return db.kv.Write(&batch)
+}
+
 func (db *DB) delete(tdef *TableDef, rec *Record) error {
 	key, err := tdef.EncodeKey(*rec)
 	if err != nil {
@@ -232,6 +258,15 @@ func (db *DB) Insert(table string, rec Record) error {
 	return db.insert(def, &rec)
 }
 
+// InsertAll inserts all records or none of them
+func (db *DB) InsertAll(table string, recs []Record) error {
+	def, err := db.getTableDef(table)
+	if err != nil {
+		return err
+	}
+	return db.insertAll(def, recs)
+}
+
 func (db *DB) Update(table string, rec Record) error {
 	def, err := db.getTableDef(table)
 	if err != nil {
@@ -308,17 +343,19 @@ func (db *DB) Execute(stmt string) (*ResultSet, error) {
 		return &result, nil
 
 	case *engine.InsertStmt:
+		recs := []Record{}
 		for _, v := range s.Values {
 			rec := NewRecord()
 
 			for i, col := range s.Columns {
 				rec.AddStr(col, []byte(v[i]))
 			}
+			recs = append(recs, rec)
+		}
 
-			err = db.Insert(s.TableName, rec)
-			if err != nil {
-				return nil, err
-			}
+		err = db.InsertAll(s.TableName, recs)
+		if err != nil {
+			return nil, err
 		}
 
 	case *engine.CreateTableStmt:
@@ -351,6 +388,10 @@ func (db *DB) Execute(stmt string) (*ResultSet, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *engine.VacuumStmt:
+		if err := db.kv.Compact(); err != nil {
+			return nil, err
+		}
 	case *engine.NoOpStmt:
 		fmt.Printf("No op\n")
 	}
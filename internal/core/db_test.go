@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"path/filepath"
 	"testing"
+
+	"github.com/pascal-sochacki/database/internal/storage"
 )
 
 func TestJsonMarshal(t *testing.T) {
@@ -328,3 +331,99 @@ func TestExecute(t *testing.T) {
 		t.Fatalf("first row and first col should be 'primary'")
 	}
 }
+
+func TestInsertMultipleRows(t *testing.T) {
+	db := CreateTempDB(t)
+	defer db.Close()
+
+	stmt := []string{
+		"CREATE TABLE test ( pk bytes, val bytes, primary key (pk))",
+		"INSERT INTO test (pk, val) VALUES ('p1', 'values1'),('p2', 'values2'),('p3', 'values3')",
+	}
+	for _, v := range stmt {
+		_, err := db.Execute(v)
+		if err != nil {
+			t.Fatalf("should not err: %v when running: %s", err, v)
+		}
+	}
+
+	records, err := db.Scan("test")
+	if err != nil {
+		t.Fatalf("should not err: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("wrong size: %d", len(records))
+	}
+	for i, rec := range records {
+		want := NewRecord()
+		want.AddStr("pk", []byte(fmt.Sprintf("p%d", i+1)))
+		want.AddStr("val", []byte(fmt.Sprintf("values%d", i+1)))
+		AssertRecord(t, rec, want)
+	}
+
+	// a row without primary key fails the whole statement
+	_, err = db.Execute("INSERT INTO test (val) VALUES ('values4'),('values5')")
+	if err == nil {
+		t.Fatalf("should err without primary key")
+	}
+}
+
+func TestExecuteVacuum(t *testing.T) {
+	db := CreateTempDB(t)
+	defer db.Close()
+
+	stmt := []string{
+		"CREATE TABLE test ( pk bytes, val bytes, primary key (pk))",
+		"INSERT INTO test (pk, val) VALUES ('p1', 'values1'),('p2', 'values2')",
+		"VACUUM",
+	}
+	for _, v := range stmt {
+		_, err := db.Execute(v)
+		if err != nil {
+			t.Fatalf("should not err: %v when running: %s", err, v)
+		}
+	}
+
+	result, err := db.Execute("SELECT * FROM test")
+	if err != nil {
+		t.Fatalf("should not err: %v", err)
+	}
+	if len(result.Rows) != 2 || result.Rows[1][1] != "values2" {
+		t.Fatalf("should keep the rows, got: %v", result.Rows)
+	}
+}
+
+func TestNewDBEmptyPath(t *testing.T) {
+	if db, err := NewDB(""); err == nil {
+		db.Close()
+		t.Fatalf("should err on an empty path")
+	}
+}
+
+func TestNewDBFromMemKV(t *testing.T) {
+	kv, err := storage.NewMemKV()
+	if err != nil {
+		t.Fatalf("should not err: %v", err)
+	}
+	db := NewDBFromKV(kv)
+	defer db.Close()
+
+	stmt := []string{
+		"CREATE TABLE test ( pk bytes, val bytes, primary key (pk))",
+		"INSERT INTO test (pk, val) VALUES ('p1', 'values1'),('p2', 'values2')",
+	}
+	for _, v := range stmt {
+		_, err := db.Execute(v)
+		if err != nil {
+			t.Fatalf("should not err: %v when running: %s", err, v)
+		}
+	}
+
+	result, err := db.Execute("SELECT * FROM test")
+	if err != nil {
+		t.Fatalf("should not err: %v", err)
+	}
+	if len(result.Rows) != 2 || result.Rows[0][1] != "values1" {
+		t.Fatalf("should return the rows, got: %v", result.Rows)
+	}
+}
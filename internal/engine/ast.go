@@ -28,6 +28,17 @@ func (n *NoOpStmt) StatementType() string {
 	return "NO_OP"
 }
 
+var _ Node = &VacuumStmt{}
+
+// VacuumStmt compacts the database file
+type VacuumStmt struct {
+}
+
+// StatementType implements Node.
+func (v *VacuumStmt) StatementType() string {
+	return "VACUUM"
+}
+
 var _ Node = &InsertStmt{}
 
 type InsertStmt struct {
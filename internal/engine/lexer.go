@@ -24,6 +24,7 @@ const (
 	TOKEN_INDEX
 	TOKEN_PRIMARY
 	TOKEN_KEY
+	TOKEN_VACUUM
 
 	// Punctuators
 	TOKEN_LPAREN    // (
@@ -55,6 +56,7 @@ var keywords = map[string]TokenType{
 	"INDEX":   TOKEN_INDEX,
 	"PRIMARY": TOKEN_PRIMARY,
 	"KEY":     TOKEN_KEY,
+	"VACUUM":  TOKEN_VACUUM,
 }
 
 func LookupIdent(ident string) TokenType {
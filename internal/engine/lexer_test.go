@@ -18,6 +18,14 @@ func TestLexer_NextToken(t *testing.T) {
 				{Type: TOKEN_EOF},
 			},
 		},
+		{
+			name:  "vacuum",
+			input: "vacuum",
+			want: []Token{
+				{Type: TOKEN_VACUUM, Literal: "vacuum"},
+				{Type: TOKEN_EOF},
+			},
+		},
 		{
 			name:  "create table",
 			input: "CREATE TABLE test ( pk bytes, val bytes, primary key (pk))",
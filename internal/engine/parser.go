@@ -43,6 +43,8 @@ func (p *Parser) ParseStatement() (Node, error) {
 		return p.parseInsertStatement()
 	case TOKEN_CREATE:
 		return p.ParseCreateStatement()
+	case TOKEN_VACUUM:
+		return &VacuumStmt{}, nil
 	}
 	return &NoOpStmt{}, nil
 
@@ -21,15 +21,16 @@ func _() {
 	_ = x[TOKEN_INDEX-10]
 	_ = x[TOKEN_PRIMARY-11]
 	_ = x[TOKEN_KEY-12]
-	_ = x[TOKEN_LPAREN-13]
-	_ = x[TOKEN_RPAREN-14]
-	_ = x[TOKEN_COMMA-15]
-	_ = x[TOKEN_SEMICOLON-16]
+	_ = x[TOKEN_VACUUM-13]
+	_ = x[TOKEN_LPAREN-14]
+	_ = x[TOKEN_RPAREN-15]
+	_ = x[TOKEN_COMMA-16]
+	_ = x[TOKEN_SEMICOLON-17]
 }
 
-const _TokenType_name = "TOKEN_ILLEGALTOKEN_EOFTOKEN_IDENTIFIERTOKEN_CREATETOKEN_INSERTTOKEN_SELECTTOKEN_FROMTOKEN_INTOTOKEN_VALUESTOKEN_TABLETOKEN_INDEXTOKEN_PRIMARYTOKEN_KEYTOKEN_LPARENTOKEN_RPARENTOKEN_COMMATOKEN_SEMICOLON"
+const _TokenType_name = "TOKEN_ILLEGALTOKEN_EOFTOKEN_IDENTIFIERTOKEN_CREATETOKEN_INSERTTOKEN_SELECTTOKEN_FROMTOKEN_INTOTOKEN_VALUESTOKEN_TABLETOKEN_INDEXTOKEN_PRIMARYTOKEN_KEYTOKEN_VACUUMTOKEN_LPARENTOKEN_RPARENTOKEN_COMMATOKEN_SEMICOLON"
 
-var _TokenType_index = [...]uint8{0, 13, 22, 38, 50, 62, 74, 84, 94, 106, 117, 128, 141, 150, 162, 174, 185, 200}
+var _TokenType_index = [...]uint8{0, 13, 22, 38, 50, 62, 74, 84, 94, 106, 117, 128, 141, 150, 162, 174, 186, 197, 212}
 
 func (i TokenType) String() string {
 	idx := int(i) - 0
@@ -0,0 +1,436 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Backup copies the pages of a snapshot while writes go on. Pages are never
+// changed in place and the snapshot keeps the ones it reaches from being
+// reused, so they can be copied as they are in the file, encrypted and
+// compressed pages included.
+
+// A full backup is a database file that Open accepts as it is. Its meta page
+// is the one of the snapshot and the pages the tree reaches are copied to
+// their place. The free list is not copied, its tail node is the one page
+// that is written in place. Every other page is written empty instead and
+// goes on a new free list in nodes after the last page.
+
+// Incremental image format
+// | sig | since | meta      | ptr | page      | ... | 0  | checksum |
+// | 16B | 8B    | META_SIZE | 8B  | page size |     | 8B | 4B       |
+
+// The checksum is a CRC32C of everything before it. Restore copies the full
+// backup next to the file asked for, writes the pages of the incremental
+// images to their place, checks the file and then compacts it into the file
+// asked for, which gets a free list of its own.
+
+// An incremental image only has the pages written after the version since,
+// the commit of an earlier backup. Files created with
+// FORMAT_PAGE_VERSIONS record in every page the commit that wrote it to the
+// file. A changed node is written to a new page together
+// with all nodes above it, so a page that is not newer than since has no
+// newer page below it and its subtree is skipped. Pages still in the log
+// have not been written yet and always go into the image. The checkpoint
+// may write them with a commit after it, so they go into the next image
+// again, at most a checkpoint of pages.
+
+const (
+	BACKUP_SIG     = "BuildYourOwnBkp1"
+	RESTORE_SUFFIX = "-restore"
+)
+
+var ErrBadBackup = errors.New("invalid backup image")
+
+// Backup writes the last commit to w as a database file. Writes and
+// compactions go on while it runs.
+func (kv *KV) Backup(w io.Writer) error {
+	_, err := kv.BackupSince(w, 0)
+	return err
+}
+
+// BackupSince writes an image of the pages written after version since to w
+// and returns the version of the image. since is the version of an earlier
+// backup of the database, 0 writes a full backup like Backup.
+func (kv *KV) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	db := kv.storage
+
+	// pages still in the log and the empty pages of a full backup are
+	// encrypted for the image with a generation of their own
+	var gen uint64
+	var err error
+	db.begin()
+	if since == 0 || db.wal != nil {
+		gen, err = db.nextGeneration()
+	}
+	snap := kv.Snapshot()
+	db.writer.Unlock()
+	defer snap.Close()
+	if err != nil {
+		return 0, err
+	}
+	view := snap.tree.storage.(readView)
+	if since == 0 {
+		return view.meta.Commit, fullBackup(w, view, gen)
+	}
+	return view.meta.Commit, backup(w, view, gen, since)
+}
+
+// readPage returns the page at ptr as it goes into a backup of view, it is
+// read from the file a compaction replaced if the snapshot was taken before
+func readPage(view readView, ptr uint64, meta *Metadata, gen uint64) ([]byte, error) {
+	var page []byte
+	err := view.read(func(db *MMapStorage) error {
+		data, pending, err := db.filePage(ptr, meta)
+		if pending {
+			data = db.encodePage(ptr, data, meta, gen)[:meta.PageSize]
+		}
+		page = data
+		return err
+	})
+	return page, err
+}
+
+// encodedPage returns node encoded for the page at ptr of a backup
+func encodedPage(view readView, ptr uint64, node []byte, meta *Metadata, gen uint64) []byte {
+	var page []byte
+	view.read(func(db *MMapStorage) error {
+		page = db.encodePage(ptr, node, meta, gen)[:meta.PageSize]
+		return nil
+	})
+	return page
+}
+
+// fullBackup writes the pages of view as a database file
+func fullBackup(w io.Writer, view readView, gen uint64) error {
+	c := newChecker(view)
+	c.tree(view.meta.Root)
+	if err := c.report.Err(); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	var free []uint64
+	for ptr := uint64(1); ptr < view.meta.Flushed; ptr++ {
+		if _, ok := c.used[ptr]; !ok {
+			free = append(free, ptr)
+		}
+	}
+
+	// the new free list holds every page the tree does not reach, its
+	// tail node always has room
+	meta := *view.meta
+	meta.Flags |= FORMAT_META_SLOTS
+	perNode := (view.PageSize() - FREE_LIST_HEADER) / 8
+	nodes := uint64(len(free)/perNode + 1)
+	meta.HeadPage, meta.HeadSeq = view.meta.Flushed, 0
+	meta.TailPage, meta.TailSeq = view.meta.Flushed+nodes-1, uint64(len(free)%perNode)
+	meta.Flushed += nodes
+
+	out := newBackupWriter(w)
+	metaPage := make([]byte, meta.PageSize)
+	copy(metaPage[meta.SlotOffset():], meta.Save())
+	out.write(metaPage)
+	empty := make([]byte, view.PageSize())
+	for ptr := uint64(1); ptr < view.meta.Flushed; ptr++ {
+		if _, ok := c.used[ptr]; !ok {
+			out.write(encodedPage(view, ptr, empty, &meta, gen))
+			continue
+		}
+		page, err := readPage(view, ptr, &meta, gen)
+		if err != nil {
+			return err
+		}
+		out.write(page)
+	}
+	for ptr := meta.HeadPage; ptr < meta.Flushed; ptr++ {
+		node := LNode(make([]byte, view.PageSize()))
+		n := min(perNode, len(free))
+		for i, page := range free[:n] {
+			node.setPtr(i, page)
+		}
+		free = free[n:]
+		if ptr < meta.TailPage {
+			node.setNext(ptr + 1)
+		}
+		out.write(encodedPage(view, ptr, node, &meta, gen))
+	}
+	return out.err
+}
+
+// backup writes an image of the pages of view written after version since
+func backup(w io.Writer, view readView, gen, since uint64) error {
+	meta := view.meta
+	if meta.Flags&FORMAT_PAGE_VERSIONS == 0 {
+		return errors.New("backup: file has no page versions, compact it first")
+	}
+	if since > meta.Commit {
+		return fmt.Errorf("backup: version %d is newer than the last commit %d", since, meta.Commit)
+	}
+	pages, err := changedPages(view, since)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	slices.Sort(pages)
+
+	out := newBackupWriter(w)
+	out.write([]byte(BACKUP_SIG))
+	out.write(binary.LittleEndian.AppendUint64(nil, since))
+	out.write(meta.Save())
+	for _, ptr := range pages {
+		page, err := readPage(view, ptr, meta, gen)
+		if err != nil {
+			return err
+		}
+		out.write(binary.LittleEndian.AppendUint64(nil, ptr))
+		out.write(page)
+	}
+	out.write(make([]byte, 8))
+	out.write(binary.LittleEndian.AppendUint32(nil, out.sum.Sum32()))
+	return out.err
+}
+
+// changedPages returns the pages of the tree of view written after version
+// since
+func changedPages(view readView, since uint64) ([]uint64, error) {
+	meta := view.meta
+	var pages []uint64
+	seen := map[uint64]bool{}
+
+	// changed reads the page at ptr and reports if it goes into the image
+	changed := func(ptr uint64) (BNode, bool, error) {
+		if ptr == 0 || ptr >= meta.Flushed || seen[ptr] {
+			return nil, false, &CorruptionError{Page: ptr, Reason: "unexpected reference"}
+		}
+		seen[ptr] = true
+		var node BNode
+		var version uint64
+		err := view.read(func(db *MMapStorage) error {
+			page, pending, err := db.filePage(ptr, meta)
+			if err != nil || pending {
+				node, version = page, math.MaxUint64
+				return err
+			}
+			body, err := db.decodeBody(ptr, page, meta)
+			if err == nil {
+				node, version = body[PAGE_VERSION:], binary.LittleEndian.Uint64(body)
+			}
+			return err
+		})
+		if err != nil || version <= since {
+			return nil, false, err
+		}
+		pages = append(pages, ptr)
+		return node, true, nil
+	}
+
+	var walk func(ptr uint64) error
+	walk = func(ptr uint64) error {
+		node, ok, err := changed(ptr)
+		if err != nil || !ok {
+			return err
+		}
+		for i := uint16(0); i < node.Keys(); i++ {
+			kid, _ := node.getPtr(i)
+			if node.Type() == BNODE_NODE {
+				if err := walk(kid); err != nil {
+					return err
+				}
+				continue
+			}
+			// a chain is written in one commit, its first page tells
+			for kid != 0 {
+				page, ok, err := changed(kid)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					break
+				}
+				kid = page.overflowNext()
+			}
+		}
+		return nil
+	}
+	if meta.Root == 0 {
+		return nil, nil
+	}
+	return pages, walk(meta.Root)
+}
+
+// backupWriter keeps the checksum of what was written and the first error
+type backupWriter struct {
+	w   io.Writer
+	sum hash.Hash32
+	err error
+}
+
+func newBackupWriter(w io.Writer) *backupWriter {
+	return &backupWriter{w: w, sum: crc32.New(castagnoli)}
+}
+
+func (b *backupWriter) write(data []byte) {
+	if b.err != nil {
+		return
+	}
+	b.sum.Write(data)
+	_, b.err = b.w.Write(data)
+}
+
+// Restore creates the database file path from a full backup and the
+// incremental images taken after it, in the order they were taken. The
+// images are written next to it first and only used once the file passed
+// its check with opts.Key and each incremental image matched its checksum
+// and continued the one before. path must not exist yet.
+func Restore(path string, image io.Reader, opts Options, incremental ...io.Reader) error {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("restore to %s: file exists", path)
+	}
+	tmpPath := path + RESTORE_SUFFIX
+	defer os.Remove(tmpPath)
+	if err := writeImages(tmpPath, image, incremental); err != nil {
+		return err
+	}
+
+	opts.WAL, opts.ReadOnly, opts.InMemory = false, false, false
+	tmp := &MMapStorage{Path: tmpPath, Options: opts}
+	if err := tmp.Open(); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadBackup, err)
+	}
+	defer tmp.Close()
+	// a chain can leave pages of the file unwritten, only the tree is read
+	report := tmp.check()
+	if len(incremental) > 0 {
+		report = tmp.tree.Check()
+	}
+	if err := report.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadBackup, err)
+	}
+
+	dst, err := tmp.copyTo(path, opts.Key)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeImages copies a full backup to a new file and writes the pages of the
+// incremental images over it, followed by the meta of the last one
+func writeImages(path string, image io.Reader, incremental []io.Reader) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove old restore: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, image); err != nil {
+		return fmt.Errorf("write image: %w", err)
+	}
+	metaPage := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := f.ReadAt(metaPage, 0); err != nil {
+		return fmt.Errorf("%w: read meta page: %w", ErrBadBackup, err)
+	}
+	meta, err := LoadMetadata(metaPage)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadBackup, err)
+	}
+
+	if len(incremental) > 0 {
+		for i, image := range incremental {
+			if meta, err = writeImage(f, image, meta); err != nil {
+				return fmt.Errorf("image %d: %w", i+1, err)
+			}
+		}
+		// the images have no free list, Open starts a new one
+		meta.HeadPage, meta.HeadSeq, meta.TailPage, meta.TailSeq = 0, 0, 0, 0
+		if err := f.Truncate(int64(meta.Flushed * meta.PageSize)); err != nil {
+			return fmt.Errorf("truncate: %w", err)
+		}
+		if _, err := f.WriteAt(meta.Save(), meta.SlotOffset()); err != nil {
+			return fmt.Errorf("write meta page: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return f.Close()
+}
+
+// writeImage writes the pages of an incremental image to f and returns its
+// meta. base is the meta of the backup before.
+func writeImage(f *os.File, image io.Reader, base *Metadata) (*Metadata, error) {
+	sum := crc32.New(castagnoli)
+	r := io.TeeReader(image, sum)
+	read := func(size int) ([]byte, error) {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadBackup, err)
+		}
+		return buf, nil
+	}
+
+	head, err := read(len(BACKUP_SIG) + 8 + META_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	if string(head[:len(BACKUP_SIG)]) != BACKUP_SIG {
+		return nil, fmt.Errorf("%w: bad signature", ErrBadBackup)
+	}
+	since := binary.LittleEndian.Uint64(head[len(BACKUP_SIG):])
+	d := head[len(BACKUP_SIG)+8:]
+	meta := NewMetadata(d)
+	if string(d[:len(DB_SIG)]) != DB_SIG || binary.LittleEndian.Uint32(d[88:92]) != metaChecksum(d, meta.Flags) {
+		return nil, fmt.Errorf("%w: bad meta", ErrBadBackup)
+	}
+	switch {
+	case since != base.Commit:
+		return nil, fmt.Errorf("%w: image since version %d does not continue version %d", ErrBadBackup, since, base.Commit)
+	case meta.PageSize != base.PageSize || meta.Flags != base.Flags:
+		return nil, fmt.Errorf("%w: image of another format", ErrBadBackup)
+	}
+
+	seen := map[uint64]bool{}
+	for {
+		buf, err := read(8)
+		if err != nil {
+			return nil, err
+		}
+		ptr := binary.LittleEndian.Uint64(buf)
+		if ptr == 0 {
+			break
+		}
+		if ptr >= meta.Flushed || seen[ptr] {
+			return nil, fmt.Errorf("%w: unexpected page %d", ErrBadBackup, ptr)
+		}
+		seen[ptr] = true
+		page, err := read(int(meta.PageSize))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.WriteAt(page, int64(ptr*meta.PageSize)); err != nil {
+			return nil, fmt.Errorf("write page: %w", err)
+		}
+	}
+	want := sum.Sum32()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(image, buf); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadBackup, err)
+	}
+	if binary.LittleEndian.Uint32(buf) != want {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrBadBackup)
+	}
+	return meta, nil
+}
@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// restored opens the database restored from image and the incremental
+// images after it
+func restored(t *testing.T, image []byte, opts Options, incremental ...[]byte) *KV {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "restored.db")
+	var readers []io.Reader
+	for _, image := range incremental {
+		readers = append(readers, bytes.NewReader(image))
+	}
+	if err := Restore(path, bytes.NewReader(image), opts, readers...); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if _, err := os.Stat(path + RESTORE_SUFFIX); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("restore should not leave a file behind: %v", err)
+	}
+	db, err := NewKVWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open restored database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Check().Err(); err != nil {
+		t.Fatalf("restored database should pass the check: %v", err)
+	}
+	return db
+}
+
+func TestKVBackup(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{WAL: true},
+		{Key: testKey, WAL: true},
+		{Compression: CODEC_DEFLATE, PrefixLeaves: true},
+	} {
+		t.Run(fmt.Sprintf("WAL=%v,Key=%v,Codec=%v", opts.WAL, opts.Key != nil, opts.Compression), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			defer db.Close()
+
+			batch := WriteBatch{}
+			for i := range 3000 {
+				batch.Put([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value%d", i)))
+			}
+			batch.Put([]byte("large"), bytes.Repeat([]byte("x"), 20000))
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			batch = WriteBatch{}
+			for i := range 3000 {
+				if i%3 != 0 {
+					batch.Delete([]byte(fmt.Sprintf("key-%06d", i)))
+				}
+			}
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+
+			var image bytes.Buffer
+			if err := db.Backup(&image); err != nil {
+				t.Fatalf("failed to back up: %v", err)
+			}
+			// writes after the backup are not in the image
+			if err := db.Insert([]byte("later"), []byte("value")); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+
+			// the image is a database file of its own
+			imagePath := filepath.Join(t.TempDir(), "image.db")
+			if err := os.WriteFile(imagePath, image.Bytes(), 0o644); err != nil {
+				t.Fatalf("failed to write image: %v", err)
+			}
+			copied, err := NewKVWithOptions(imagePath, Options{Key: opts.Key})
+			if err != nil {
+				t.Fatalf("failed to open image: %v", err)
+			}
+			report := copied.Check()
+			if err := report.Err(); err != nil || len(report.Leaked) != 0 {
+				t.Fatalf("image should pass the check: %v, leaked: %v", err, report.Leaked)
+			}
+			if report.Free == 0 {
+				t.Fatal("image should have the unused pages on its free list")
+			}
+			if val, found, err := copied.Get([]byte("key-000003")); err != nil || !found || string(val) != "value3" {
+				t.Fatalf("image should have the keys: %s, %v, %v", val, found, err)
+			}
+			// writes take their pages from the new free list
+			if err := copied.Insert([]byte("copied"), []byte("value")); err != nil {
+				t.Fatalf("failed to insert into image: %v", err)
+			}
+			if err := copied.Check().Err(); err != nil {
+				t.Fatalf("image should pass the check after a write: %v", err)
+			}
+			copied.Close()
+
+			backup := restored(t, image.Bytes(), Options{Key: opts.Key})
+			for i := range 3000 {
+				val, found, err := backup.Get([]byte(fmt.Sprintf("key-%06d", i)))
+				if err != nil {
+					t.Fatalf("failed to get: %v", err)
+				}
+				if found != (i%3 == 0) {
+					t.Fatalf("key %d exists: %v", i, found)
+				}
+				if found && string(val) != fmt.Sprintf("value%d", i) {
+					t.Fatalf("key %d mismatch: %s", i, val)
+				}
+			}
+			if val, _, err := backup.Get([]byte("large")); err != nil || len(val) != 20000 {
+				t.Fatalf("large value mismatch: %d bytes, %v", len(val), err)
+			}
+			if _, found, _ := backup.Get([]byte("later")); found {
+				t.Fatal("image should not have writes after the backup")
+			}
+			if opts.Key != nil && backup.storage.Metadata.Salt == db.storage.Metadata.Salt {
+				t.Fatal("restored file should get a salt of its own")
+			}
+		})
+	}
+}
+
+func TestKVBackupDuringWrites(t *testing.T) {
+	db, err := NewKVWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{WAL: true, CheckpointSize: 64 << 10})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// every commit adds a key and moves the counter to it
+	write := func(i int) error {
+		batch := WriteBatch{}
+		batch.Put([]byte(fmt.Sprintf("key-%06d", i)), bytes.Repeat([]byte("v"), 100))
+		batch.Put([]byte("counter"), []byte(strconv.Itoa(i)))
+		return db.Write(&batch)
+	}
+	for i := range 500 {
+		if err := write(i); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 500; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := write(i); err != nil {
+				t.Errorf("failed to write: %v", err)
+				return
+			}
+		}
+	}()
+
+	var images [][]byte
+	for range 5 {
+		var image bytes.Buffer
+		if err := db.Backup(&image); err != nil {
+			t.Fatalf("failed to back up: %v", err)
+		}
+		images = append(images, image.Bytes())
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, image := range images {
+		backup := restored(t, image, Options{})
+		val, _, err := backup.Get([]byte("counter"))
+		if err != nil {
+			t.Fatalf("failed to get counter: %v", err)
+		}
+		last, _ := strconv.Atoi(string(val))
+		count := 0
+		for range backup.Scan([]byte("key-"), []byte("key.")) {
+			count++
+		}
+		if count != last+1 {
+			t.Fatalf("image should hold the keys of one commit, counter: %d, keys: %d", last, count)
+		}
+	}
+}
+
+func TestRestoreValidates(t *testing.T) {
+	db, err := NewKVWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := range 200 {
+		if err := db.Insert([]byte(fmt.Sprintf("key-%06d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	image := buf.Bytes()
+
+	flipped := bytes.Clone(image)
+	flipped[len(flipped)/2] ^= 0x01
+	cases := map[string][]byte{
+		"truncated": image[:len(image)-100],
+		"flipped":   flipped,
+		"empty":     nil,
+		"not image": bytes.Repeat([]byte("x"), 1000),
+	}
+	for name, image := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "restored.db")
+			if err := Restore(path, bytes.NewReader(image), Options{Key: testKey}); !errors.Is(err, ErrBadBackup) {
+				t.Fatalf("restore should fail with ErrBadBackup, got: %v", err)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("failed restore should not create the file: %v", err)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if err := Restore(path, bytes.NewReader(image), Options{Key: otherKey}); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("restore with another key should fail with ErrWrongKey, got: %v", err)
+	}
+	if err := Restore(path, bytes.NewReader(image), Options{Key: testKey}); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if err := Restore(path, bytes.NewReader(image), Options{Key: testKey}); err == nil {
+		t.Fatal("restore should not replace an existing file")
+	}
+}
+
+// sameContent compares the keys and values of db with want
+func sameContent(t *testing.T, db *KV, want map[string]string) {
+	t.Helper()
+	count := 0
+	for key, val := range db.Scan(nil, nil) {
+		if want[string(key)] != string(val) {
+			t.Fatalf("key %s mismatch: %.20s, want: %.20s", key, val, want[string(key)])
+		}
+		count++
+	}
+	if count != len(want) {
+		t.Fatalf("should have %d keys, got: %d", len(want), count)
+	}
+}
+
+func TestKVBackupIncremental(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{WAL: true, CheckpointSize: 64 << 10},
+		{Key: testKey, Compression: CODEC_DEFLATE},
+	} {
+		t.Run(fmt.Sprintf("WAL=%v,Key=%v,Codec=%v", opts.WAL, opts.Key != nil, opts.Compression), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+
+			want := map[string]string{}
+			batch := WriteBatch{}
+			for i := range 5000 {
+				key, val := fmt.Sprintf("key-%06d", i), fmt.Sprintf("value%d", i)
+				batch.Put([]byte(key), []byte(val))
+				want[key] = val
+			}
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			// pages still in the log would go into the first incremental
+			// image again
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close database: %v", err)
+			}
+			if db, err = NewKVWithOptions(dbPath, opts); err != nil {
+				t.Fatalf("failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			var full bytes.Buffer
+			version, err := db.BackupSince(&full, 0)
+			if err != nil {
+				t.Fatalf("failed to back up: %v", err)
+			}
+
+			var images [][]byte
+			states := []map[string]string{maps.Clone(want)}
+			for round := 1; round <= 3; round++ {
+				batch := WriteBatch{}
+				for i := round; i < 5000; i += 500 {
+					key, val := fmt.Sprintf("key-%06d", i), fmt.Sprintf("round%d", round)
+					batch.Put([]byte(key), []byte(val))
+					want[key] = val
+				}
+				batch.Delete([]byte(fmt.Sprintf("key-%06d", 1000+round)))
+				delete(want, fmt.Sprintf("key-%06d", 1000+round))
+				large := strings.Repeat(strconv.Itoa(round), 10000)
+				batch.Put([]byte(fmt.Sprintf("large%d", round)), []byte(large))
+				want[fmt.Sprintf("large%d", round)] = large
+				if err := db.Write(&batch); err != nil {
+					t.Fatalf("failed to write: %v", err)
+				}
+
+				var image bytes.Buffer
+				next, err := db.BackupSince(&image, version)
+				if err != nil {
+					t.Fatalf("failed to back up since %d: %v", version, err)
+				}
+				if next <= version {
+					t.Fatalf("image should have a newer version than %d, got: %d", version, next)
+				}
+				if 2*image.Len() > full.Len() {
+					t.Fatalf("incremental image should only hold the changed pages: %d bytes, full: %d", image.Len(), full.Len())
+				}
+				version = next
+				images = append(images, image.Bytes())
+				states = append(states, maps.Clone(want))
+			}
+
+			// any prefix of the chain restores the state of its last image
+			for n := range len(images) + 1 {
+				backup := restored(t, full.Bytes(), Options{Key: opts.Key}, images[:n]...)
+				sameContent(t, backup, states[n])
+			}
+
+			// nothing changed, nothing but the meta unless pages are still
+			// in the log
+			var empty bytes.Buffer
+			if _, err := db.BackupSince(&empty, version); err != nil {
+				t.Fatalf("failed to back up: %v", err)
+			}
+			if !opts.WAL && empty.Len() != len(BACKUP_SIG)+8+META_SIZE+8+4 {
+				t.Fatalf("image without changes should hold no pages: %d bytes", empty.Len())
+			}
+			if _, err := db.BackupSince(&empty, version+1); err == nil {
+				t.Fatal("backup since a version that was not committed yet should fail")
+			}
+		})
+	}
+}
+
+func TestKVBackupIncrementalAfterCompact(t *testing.T) {
+	db, err := NewKV(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	want := map[string]string{}
+	for i := range 500 {
+		key := fmt.Sprintf("key-%06d", i)
+		if err := db.Insert([]byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		want[key] = "value"
+	}
+	var full bytes.Buffer
+	version, err := db.BackupSince(&full, 0)
+	if err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+
+	// the compacted file moves every page, its versions go on
+	if err := db.Compact(); err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	if db.storage.Metadata.Commit <= version {
+		t.Fatalf("compaction should keep the version, got: %d, backup: %d", db.storage.Metadata.Commit, version)
+	}
+	if err := db.Insert([]byte("after"), []byte("compact")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	want["after"] = "compact"
+	var image bytes.Buffer
+	if _, err := db.BackupSince(&image, version); err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	sameContent(t, restored(t, full.Bytes(), Options{}, image.Bytes()), want)
+}
+
+func TestRestoreValidatesChain(t *testing.T) {
+	db, err := NewKV(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var full bytes.Buffer
+	version, err := db.BackupSince(&full, 0)
+	if err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	var images [][]byte
+	for i := range 2 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		var image bytes.Buffer
+		if version, err = db.BackupSince(&image, version); err != nil {
+			t.Fatalf("failed to back up: %v", err)
+		}
+		images = append(images, image.Bytes())
+	}
+
+	cases := map[string][][]byte{
+		"incremental first": {images[0], images[1]},
+		"gap":               {full.Bytes(), images[1]},
+		"wrong order":       {full.Bytes(), images[1], images[0]},
+		"full twice":        {full.Bytes(), full.Bytes()},
+	}
+	for name, chain := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "restored.db")
+			var incremental []io.Reader
+			for _, image := range chain[1:] {
+				incremental = append(incremental, bytes.NewReader(image))
+			}
+			if err := Restore(path, bytes.NewReader(chain[0]), Options{}, incremental...); !errors.Is(err, ErrBadBackup) {
+				t.Fatalf("restore should fail with ErrBadBackup, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemKVBackup(t *testing.T) {
+	db, err := NewMemKV()
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	var image bytes.Buffer
+	if err := db.Backup(&image); err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	backup := restored(t, image.Bytes(), Options{})
+	if val, _, err := backup.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Fatalf("key should be restored: %s, %v", val, err)
+	}
+}
@@ -3,12 +3,15 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"iter"
+	"math"
 )
 
-const BTREE_PAGE_SIZE = 4096
-const BTREE_MAX_KEY_SIZE = 1000
+const BTREE_PAGE_SIZE = 4096      // default and smallest page size
+const BTREE_MAX_PAGE_SIZE = 65536 // offsets are 16 bit
+const BTREE_MAX_KEY_SIZE = 1000   // limits for the default page size, see maxKeySize
 const BTREE_MAX_VAL_SIZE = 3000
 const HEADER = 4
 
@@ -16,62 +19,113 @@ const HEADER = 4
 // | type | nkeys | pointers   | offsets    | key-values | unused |
 // | 2B   | 2B    | nkeys × 8B | nkeys × 2B | ...        |        |
 
+// Leaves can also use the prefixed format, see prefix.go
+
 // Key Values format
 // | key_size | val_size | key | val |
 // | 2B       | 2B       | ... | ... |
 
+// Leaf pointers are 0, unless the value lives in overflow pages (see overflow.go)
+
 func init() {
-	node1max := HEADER + 1*8 + 1*2 + 2 + BTREE_MAX_KEY_SIZE + 2 + BTREE_MAX_VAL_SIZE
-	if node1max > BTREE_PAGE_SIZE {
-		panic("assertion failure")
+	for pageSize := BTREE_PAGE_SIZE; pageSize <= BTREE_MAX_PAGE_SIZE; pageSize *= 2 {
+		node1max := HEADER + 1*8 + 1*2 + 2 + maxKeySize(pageSize) + 2 + maxValSize(pageSize)
+		if node1max > nodeCap(pageSize) {
+			panic("assertion failure")
+		}
 	}
 }
 
+// ValidPageSize reports whether files can use pages of the given size
+func ValidPageSize(pageSize int) bool {
+	return BTREE_PAGE_SIZE <= pageSize && pageSize <= BTREE_MAX_PAGE_SIZE && pageSize&(pageSize-1) == 0
+}
+
+// maxKeySize is the largest key a page of pageSize holds, the limits grow
+// with the page
+func maxKeySize(pageSize int) int {
+	return BTREE_MAX_KEY_SIZE * pageSize / BTREE_PAGE_SIZE
+}
+
+// maxValSize is the largest value stored inline, larger ones go to overflow
+// pages. The top bit of the size is VAL_OVERFLOW in prefixed leaves.
+func maxValSize(pageSize int) int {
+	return min(BTREE_MAX_VAL_SIZE*pageSize/BTREE_PAGE_SIZE, VAL_OVERFLOW-1)
+}
+
+// nodeCap is the number of bytes a node may use. The end of a node has to be
+// addressable by a 16 bit offset, so 64K pages leave their last byte unused.
+func nodeCap(pageSize int) int {
+	return min(pageSize, math.MaxUint16)
+}
+
 type BTree struct {
 	metaData *Metadata
 	storage  Storage
 }
 
 func NewBTree(storage Storage, metadata *Metadata) (BTree, error) {
-	root := BNode(make([]byte, BTREE_PAGE_SIZE))
-	root.setHeader(BNODE_LEAF, 0)
-	idx, err := storage.New(root)
+	tree := BTree{
+		metaData: metadata,
+		storage:  storage,
+	}
+	idx, err := storage.New(tree.emptyLeaf())
 	metadata.Root = idx
 	if err != nil {
 		return BTree{}, err
 	}
+	return tree, nil
+}
 
-	return BTree{
-		metaData: metadata,
-		storage:  storage,
-	}, nil
+// Scanner is a range scan that reports read errors. Range over All and check
+// Err afterwards, a scan that fails to read the tree stops early and Err
+// tells why.
+type Scanner struct {
+	scan func(yield func([]byte, []byte) bool) error
+	err  error
 }
 
-func (tree *BTree) Scan(start, end []byte) iter.Seq2[[]byte, []byte] {
+func (s *Scanner) All() iter.Seq2[[]byte, []byte] {
 	return func(yield func([]byte, []byte) bool) {
-		if tree.metaData.Root == 0 {
-			return
-		}
-
-		// We start the recursive scan from the root
-		tree.scanRecursive(tree.metaData.Root, start, end, yield)
+		s.err = s.scan(yield)
 	}
 }
 
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Scan iterates the keys from start up to but not including end, nil leaves
+// that end open. A read error ends it early, use NewScanner to see it.
+func (tree *BTree) Scan(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return tree.NewScanner(start, end).All()
+}
+
+// All iterates all keys of the tree
 func (tree *BTree) All() iter.Seq2[[]byte, []byte] {
-	return func(yield func([]byte, []byte) bool) {
+	return tree.NewScanner(nil, nil).All()
+}
+
+// NewScanner returns the scan of the keys from start up to but not
+// including end
+func (tree *BTree) NewScanner(start, end []byte) *Scanner {
+	return &Scanner{scan: func(yield func([]byte, []byte) bool) error {
 		if tree.metaData.Root == 0 {
-			return
+			return nil
 		}
 
-		tree.scanRecursive(tree.metaData.Root, nil, nil, yield)
-	}
+		// We start the recursive scan from the root
+		_, err := tree.scanRecursive(tree.metaData.Root, start, end, yield)
+		return err
+	}}
 }
 
-func (t *BTree) scanRecursive(ptr uint64, start []byte, end []byte, yield func([]byte, []byte) bool) bool {
+// scanRecursive returns false once the scan is done, because of end, the
+// caller or an error
+func (t *BTree) scanRecursive(ptr uint64, start []byte, end []byte, yield func([]byte, []byte) bool) (bool, error) {
 	data, err := t.storage.Get(ptr)
 	if err != nil {
-		return false // Or handle error via a field in a wrapper struct
+		return false, err
 	}
 	node := BNode(data)
 
@@ -80,52 +134,187 @@ func (t *BTree) scanRecursive(ptr uint64, start []byte, end []byte, yield func([
 		startIdx := uint16(0)
 
 		if start != nil {
-			idx, _, _ := node.Lookup(start)
-			startIdx = idx
+			startIdx, _, err = node.Lookup(start)
+			if err != nil {
+				return false, err
+			}
 		}
 
 		for i := startIdx; i < nkeys; i++ {
-			key, _ := node.getKey(i)
-			val, _ := node.getVal(i)
+			key, err := node.getKey(i)
+			if err != nil {
+				return false, err
+			}
 
 			if end != nil && bytes.Compare(key, end) >= 0 {
-				return false // Stop everything
+				return false, nil // Stop everything
+			}
+
+			val, err := node.leafValue(i, t.storage)
+			if err != nil {
+				return false, err
 			}
 
 			if !yield(key, val) {
-				return false // Caller stopped the loop
+				return false, nil // Caller stopped the loop
 			}
 		}
-		return true
+		return true, nil
 	}
 
 	nkeys := node.Keys()
 	startIdx := uint16(0)
 	if start != nil {
 		// Use LookupLE to find the first child that could contain start
-		startIdx, _ = node.LookupLE(start)
+		startIdx, err = node.LookupLE(start)
+		if err != nil {
+			return false, err
+		}
 	}
 
 	for i := startIdx; i < nkeys; i++ {
-		for i := uint16(0); i < node.Keys(); i++ {
-			if i > startIdx && end != nil {
-				childFirstKey, _ := node.getKey(i)
-				if bytes.Compare(childFirstKey, end) >= 0 {
-					return false
-				}
+		if i > startIdx && end != nil {
+			childFirstKey, err := node.getKey(i)
+			if err != nil {
+				return false, err
+			}
+			if bytes.Compare(childFirstKey, end) >= 0 {
+				return false, nil
 			}
+		}
+
+		childPtr, err := node.getPtr(i)
+		if err != nil {
+			return false, err
+		}
+		if more, err := t.scanRecursive(childPtr, start, end, yield); !more {
+			return false, err
+		}
 
-			childPtr, _ := node.getPtr(i)
-			if !t.scanRecursive(childPtr, start, end, yield) {
-				return false
+		// After the first child is processed, we no longer need the start restriction
+		// for subsequent siblings in the recursion.
+		start = nil
+	}
+	return true, nil
+}
+
+// Bound is one end of a range. A nil key leaves that end open.
+type Bound struct {
+	Key       []byte
+	Inclusive bool
+}
+
+func Inclusive(key []byte) Bound {
+	return Bound{Key: key, Inclusive: true}
+}
+
+func Exclusive(key []byte) Bound {
+	return Bound{Key: key}
+}
+
+// below reports whether key is outside the range it is the lower bound of
+func (lo Bound) below(key []byte) bool {
+	if lo.Key == nil {
+		return false
+	}
+	cmp := bytes.Compare(key, lo.Key)
+	return cmp < 0 || (cmp == 0 && !lo.Inclusive)
+}
+
+// ScanReverse iterates the keys between lo and hi from the largest to the
+// smallest one. A read error ends it early, use NewReverseScanner to see it.
+func (tree *BTree) ScanReverse(lo, hi Bound) iter.Seq2[[]byte, []byte] {
+	return tree.NewReverseScanner(lo, hi).All()
+}
+
+// NewReverseScanner returns the scan of the keys between lo and hi in
+// descending order
+func (tree *BTree) NewReverseScanner(lo, hi Bound) *Scanner {
+	return &Scanner{scan: func(yield func([]byte, []byte) bool) error {
+		if tree.metaData.Root == 0 {
+			return nil
+		}
+
+		_, err := tree.scanReverse(tree.metaData.Root, lo, hi, yield)
+		return err
+	}}
+}
+
+func (t *BTree) scanReverse(ptr uint64, lo, hi Bound, yield func([]byte, []byte) bool) (bool, error) {
+	data, err := t.storage.Get(ptr)
+	if err != nil {
+		return false, err
+	}
+	node := BNode(data)
+	nkeys := node.Keys()
+
+	if node.Type() == BNODE_LEAF {
+		// Start at the last key that is not above hi
+		startIdx := int(nkeys) - 1
+		if hi.Key != nil {
+			idx, ok, err := node.Lookup(hi.Key)
+			if err != nil {
+				return false, err
+			}
+			startIdx = int(idx) - 1
+			if ok && hi.Inclusive {
+				startIdx = int(idx)
 			}
+		}
+
+		for i := startIdx; i >= 0; i-- {
+			key, err := node.getKey(uint16(i))
+			if err != nil {
+				return false, err
+			}
+			if lo.below(key) {
+				return false, nil // Stop everything
+			}
+
+			val, err := node.leafValue(uint16(i), t.storage)
+			if err != nil {
+				return false, err
+			}
+
+			if !yield(key, val) {
+				return false, nil // Caller stopped the loop
+			}
+		}
+		return true, nil
+	}
 
-			// After the first child is processed, we no longer need the start restriction
-			// for subsequent siblings in the recursion.
-			start = nil
+	// The last child that can contain hi
+	startIdx := int(nkeys) - 1
+	if hi.Key != nil {
+		idx, err := node.LookupLE(hi.Key)
+		if err != nil {
+			return false, err
 		}
+		startIdx = int(idx)
 	}
-	return true
+
+	for i := startIdx; i >= 0; i-- {
+		childPtr, err := node.getPtr(uint16(i))
+		if err != nil {
+			return false, err
+		}
+		if more, err := t.scanReverse(childPtr, lo, hi, yield); !more {
+			return false, err
+		}
+
+		// The children to the left only have smaller keys
+		childFirstKey, err := node.getKey(uint16(i))
+		if err != nil {
+			return false, err
+		}
+		if lo.below(childFirstKey) {
+			return false, nil
+		}
+
+		// Only the first child can have keys above hi
+		hi = Bound{}
+	}
+	return true, nil
 }
 
 func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
@@ -147,7 +336,7 @@ func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
 				return nil, false, err
 			}
 			if ok {
-				val, err := current.getVal(idx)
+				val, err := current.leafValue(idx, tree.storage)
 				return val, ok, err
 			}
 			return nil, false, nil
@@ -174,12 +363,10 @@ func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
 }
 
 func (tree *BTree) Insert(key []byte, val []byte) error {
-	if len(key) > BTREE_MAX_KEY_SIZE {
+	pageSize := tree.storage.PageSize()
+	if len(key) > maxKeySize(pageSize) {
 		return fmt.Errorf("key to large")
 	}
-	if len(val) > BTREE_MAX_VAL_SIZE {
-		return fmt.Errorf("value to large")
-	}
 
 	data, err := tree.storage.Get(tree.metaData.Root)
 	if err != nil {
@@ -189,22 +376,31 @@ func (tree *BTree) Insert(key []byte, val []byte) error {
 	current := BNode(data)
 
 	ctx := &insertContext{storage: tree.storage, toDelete: []uint64{}}
-	new, err := current.Insert(key, val, ctx)
-	if err != nil {
-		return err
+
+	// Large values go to overflow pages, the leaf only keeps the size
+	ptr := uint64(0)
+	if len(val) > maxValSize(pageSize) {
+		ptr, err = writeOverflow(val, tree.storage)
+		if err != nil {
+			return err
+		}
+		val = binary.LittleEndian.AppendUint64(nil, uint64(len(val)))
 	}
 
 	old := tree.metaData.Root
-	tree.metaData.Root, err = tree.storage.New(new)
+	kids, err := current.Insert(key, ptr, val, ctx)
+	if err == nil {
+		err = tree.setRoot(kids, ctx)
+	}
 	if err != nil {
-		return err
+		// Keep the old root, nothing references the overflow chain
+		tree.metaData.Root = old
+		return errors.Join(err, freeOverflow(ptr, tree.storage))
 	}
 
 	// Only delete old pages after root is safely updated
 	ctx.toDelete = append(ctx.toDelete, old)
-	ctx.CommitDeletions()
-
-	return nil
+	return ctx.CommitDeletions()
 }
 
 func (tree *BTree) Delete(key []byte) error {
@@ -215,21 +411,52 @@ func (tree *BTree) Delete(key []byte) error {
 
 	current := BNode(data)
 	ctx := &insertContext{storage: tree.storage, toDelete: []uint64{}}
-	new, err := current.Delete(key, ctx)
+	kids, err := current.Delete(key, ctx)
 	if err != nil {
 		return err
 	}
+	if kids == nil {
+		// key not found, nothing changed
+		return nil
+	}
 
 	old := tree.metaData.Root
-	tree.metaData.Root, err = tree.storage.New(new)
-	if err != nil {
+	if err := tree.setRoot(kids, ctx); err != nil {
 		return err
 	}
 
 	// Only delete old pages after root is safely updated
 	ctx.toDelete = append(ctx.toDelete, old)
-	ctx.CommitDeletions()
-	return nil
+	return ctx.CommitDeletions()
+}
+
+// setRoot stores the updated root. Roots split into several nodes get new
+// levels on top, an internal root with a single child is replaced by that
+// child and an internal root without children becomes an empty leaf.
+func (tree *BTree) setRoot(kids []BNode, storage Storage) error {
+	for len(kids) > 1 {
+		entries, err := kidEntries(kids, storage)
+		if err != nil {
+			return err
+		}
+		kids = pack(BNODE_NODE, false, entries, storage.PageSize())
+	}
+
+	root := kids[0]
+	var err error
+	if root.Type() == BNODE_NODE && root.Keys() == 1 {
+		tree.metaData.Root, err = root.getPtr(0)
+		return err
+	}
+	if root.Type() == BNODE_NODE && root.Keys() == 0 {
+		root = tree.emptyLeaf()
+	}
+	tree.metaData.Root, err = storage.New(root)
+	return err
+}
+
+func (tree *BTree) emptyLeaf() BNode {
+	return buildNode(BNODE_LEAF, tree.metaData.Flags&FORMAT_PREFIX_LEAVES != 0, nil, tree.storage.PageSize())
 }
 
 type insertContext struct {
@@ -247,43 +474,63 @@ func (ctx *insertContext) New(data []byte) (uint64, error) {
 	return ctx.storage.New(data)
 }
 
+func (ctx *insertContext) PageSize() int {
+	return ctx.storage.PageSize()
+}
+
 func (ctx *insertContext) Delete(ptr uint64) error {
 	// Don't delete immediately - add to journal
 	ctx.toDelete = append(ctx.toDelete, ptr)
 	return nil
 }
 
-func (ctx *insertContext) CommitDeletions() {
+func (ctx *insertContext) CommitDeletions() error {
 	for _, ptr := range ctx.toDelete {
-		ctx.storage.Delete(ptr)
+		if err := ctx.storage.Delete(ptr); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 type BNode []byte
 
-func (node BNode) Insert(key []byte, val []byte, storage Storage) (BNode, error) {
+// Insert adds key to the subtree rooted at node and returns the updated
+// subtree as one or more page sized nodes. ptr is the first overflow page of
+// the value or 0 if val is stored inline.
+func (node BNode) Insert(key []byte, ptr uint64, val []byte, storage Storage) ([]BNode, error) {
 	if node.Type() == BNODE_NODE {
-		return node.insertIntoInternal(key, val, storage)
+		return node.insertIntoInternal(key, ptr, val, storage)
 	}
 
 	if node.Type() == BNODE_LEAF {
-		return node.insertIntoLeaf(key, val, storage)
+		return node.insertIntoLeaf(key, ptr, val, storage)
 	}
 
 	return nil, fmt.Errorf("should not happen")
 }
 
-func (node BNode) Delete(key []byte, storage Storage) (BNode, error) {
+// Delete removes key from the subtree rooted at node. It returns nil if the
+// key does not exist, otherwise the updated subtree as page sized nodes. A
+// single node may be underfull or empty, its parent rebalances it.
+func (node BNode) Delete(key []byte, storage Storage) ([]BNode, error) {
 	if node.Type() == BNODE_LEAF {
 		idx, ok, err := node.Lookup(key)
 		if err != nil {
 			return nil, err
 		}
 		if !ok {
-			return node, nil
+			return nil, nil
+		}
+		new, err := node.DeleteValue(idx)
+		if err != nil {
+			return nil, err
+		}
+		if err := node.freeLeafValue(idx, storage); err != nil {
+			return nil, err
 		}
 
-		return node.DeleteValue(idx), nil
+		return []BNode{new}, nil
 
 	}
 	if node.Type() == BNODE_NODE {
@@ -302,33 +549,85 @@ func (node BNode) Delete(key []byte, storage Storage) (BNode, error) {
 		}
 
 		child := BNode(data)
-		newChild, err := child.Delete(key, storage)
+		kids, err := child.Delete(key, storage)
 		if err != nil {
 			return nil, err
 		}
-		newChildPtr, err := storage.New(newChild)
-		if err != nil {
-			return nil, err
+		if kids == nil {
+			return nil, nil
 		}
 		storage.Delete(ptr)
 
-		// Update the child pointer at this index
-		new := node.UpdatePtr(idx, newChildPtr)
-		return new.splitIfNeeded(storage)
+		return node.rebalance(idx, kids, storage)
 
 	}
 	return nil, fmt.Errorf("should not happen")
 }
 
+// rebalance puts the updated child at idx back into node. Empty children are
+// dropped, underfull children are merged with a sibling when the result fits
+// into a page and otherwise borrow keys from it.
+func (node BNode) rebalance(idx uint16, kids []BNode, storage Storage) ([]BNode, error) {
+	if len(kids) == 1 && kids[0].Keys() == 0 {
+		return node.ReplaceKids(idx, 1, nil, storage)
+	}
+	if len(kids) > 1 || node.Keys() == 1 {
+		return node.ReplaceKids(idx, 1, kids, storage)
+	}
+	child := kids[0]
+	size, err := child.usedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if int(size) > storage.PageSize()/4 {
+		return node.ReplaceKids(idx, 1, kids, storage)
+	}
+
+	// Prefer the left sibling, fall back to the right one
+	siblingIdx := idx + 1
+	if idx > 0 {
+		siblingIdx = idx - 1
+	}
+	siblingPtr, err := node.getPtr(siblingIdx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := storage.Get(siblingPtr)
+	if err != nil {
+		return nil, err
+	}
+	sibling := BNode(data)
+	storage.Delete(siblingPtr)
+
+	left, right := sibling, child
+	if siblingIdx > idx {
+		left, right = child, sibling
+	}
+	entries, err := left.entries(0, left.Keys())
+	if err != nil {
+		return nil, err
+	}
+	entries, err = right.appendEntries(entries, 0, right.Keys())
+	if err != nil {
+		return nil, err
+	}
+
+	// Both fit into one page: merge, otherwise borrow by spreading the keys
+	merged := pack(child.Type(), child.prefixed(), entries, storage.PageSize())
+	return node.ReplaceKids(min(idx, siblingIdx), 2, merged, storage)
+}
+
 type Type uint16
 
 var (
 	BNODE_NODE Type = 1 // internal nodes without values
 	BNODE_LEAF Type = 2 // leaf nodes with values
+
+	BNODE_OVERFLOW Type = 3 // pages of values stored out of line
 )
 
 func (node BNode) Type() Type {
-	return Type(binary.LittleEndian.Uint16(node[0:2]))
+	return Type(binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIXED)
 }
 
 func (node BNode) Keys() uint16 {
@@ -339,6 +638,9 @@ func (node BNode) getPtr(idx uint16) (uint64, error) {
 	if idx >= node.Keys() {
 		return 0, fmt.Errorf("out of bound")
 	}
+	if node.prefixed() {
+		return node.prefixedPtr(idx)
+	}
 	pos := HEADER + 8*idx
 	return binary.LittleEndian.Uint64(node[pos:]), nil
 }
@@ -357,11 +659,19 @@ func (node BNode) setHeader(btype Type, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node[2:4], nkeys)
 }
 
+// offsetsStart is the position of the offsets array
+func (node BNode) offsetsStart() uint16 {
+	if node.prefixed() {
+		return HEADER + 2 + node.prefixLen()
+	}
+	return HEADER + 8*node.Keys()
+}
+
 func (node BNode) getOffset(idx uint16) uint16 {
 	if idx == 0 {
 		return 0
 	}
-	pos := HEADER + 8*node.Keys() + 2*(idx-1)
+	pos := node.offsetsStart() + 2*(idx-1)
 	return binary.LittleEndian.Uint16(node[pos:])
 }
 
@@ -369,7 +679,7 @@ func (node BNode) keyValuePosition(idx uint16) (uint16, error) {
 	if idx > node.Keys() {
 		return 0, fmt.Errorf("out of bound")
 	}
-	return HEADER + 8*node.Keys() + 2*node.Keys() + node.getOffset(idx), nil
+	return node.offsetsStart() + 2*node.Keys() + node.getOffset(idx), nil
 }
 
 func (node BNode) getKey(idx uint16) ([]byte, error) {
@@ -378,7 +688,12 @@ func (node BNode) getKey(idx uint16) ([]byte, error) {
 		return []byte{}, err
 	}
 	klen := binary.LittleEndian.Uint16(node[pos:])
-	return node[pos+HEADER:][:klen], nil
+	key := node[pos+HEADER:][:klen]
+	if node.prefixed() {
+		// only the suffix is stored
+		return append(append([]byte{}, node.prefix()...), key...), nil
+	}
+	return key, nil
 }
 
 func (node BNode) getVal(idx uint16) ([]byte, error) {
@@ -388,15 +703,47 @@ func (node BNode) getVal(idx uint16) ([]byte, error) {
 	}
 	klen := binary.LittleEndian.Uint16(node[pos+0:])
 	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	if node.prefixed() && vlen&VAL_OVERFLOW != 0 {
+		// the size of the value, its first page follows
+		return node[pos+HEADER+klen:][:8], nil
+	}
 	return node[pos+HEADER+klen:][:vlen], nil
 }
 
+// compareKey compares the key at idx with key without copying prefixed keys
+func (node BNode) compareKey(idx uint16, key []byte) (int, error) {
+	if !node.prefixed() {
+		currentKey, err := node.getKey(idx)
+		if err != nil {
+			return 0, err
+		}
+		return bytes.Compare(currentKey, key), nil
+	}
+
+	pos, err := node.keyValuePosition(idx)
+	if err != nil {
+		return 0, err
+	}
+	prefix := node.prefix()
+	if len(key) < len(prefix) {
+		if cmp := bytes.Compare(prefix[:len(key)], key); cmp != 0 {
+			return cmp, nil
+		}
+		return 1, nil
+	}
+	if cmp := bytes.Compare(prefix, key[:len(prefix)]); cmp != 0 {
+		return cmp, nil
+	}
+	klen := binary.LittleEndian.Uint16(node[pos:])
+	return bytes.Compare(node[pos+HEADER:][:klen], key[len(prefix):]), nil
+}
+
 func offsetPos(node BNode, idx uint16) (uint16, error) {
 	if 1 > idx || idx > node.Keys() {
 		return 0, fmt.Errorf("out of bound")
 
 	}
-	return HEADER + 8*node.Keys() + 2*(idx-1), nil
+	return node.offsetsStart() + 2*(idx-1), nil
 }
 
 func (node BNode) usedBytes() (uint16, error) {
@@ -414,6 +761,9 @@ func (node BNode) setOffset(idx uint16, offset uint16) error {
 }
 
 func (node BNode) AppendKV(idx uint16, ptr uint64, key []byte, val []byte) error {
+	if node.prefixed() {
+		return node.appendPrefixedKV(idx, ptr, key, val)
+	}
 	// ptrs
 	node.setPtr(idx, ptr)
 	// KVs
@@ -432,197 +782,244 @@ func (node BNode) AppendKV(idx uint16, ptr uint64, key []byte, val []byte) error
 	return nil
 }
 
-func (old BNode) InsertValue(idx uint16, key []byte, val []byte) BNode {
-	new := make(BNode, BTREE_PAGE_SIZE*2)
-	new.setHeader(BNODE_LEAF, old.Keys()+1)
-	new.AppendRange(old, 0, 0, idx)                  // copy the keys before `idx`
-	new.AppendKV(idx, 0, key, val)                   // the new key
-	new.AppendRange(old, idx+1, idx, old.Keys()-idx) // keys from `idx`
-	return new
-}
-
-func (old BNode) UpdatePtr(idx uint16, ptr uint64) BNode {
-	new := make(BNode, BTREE_PAGE_SIZE*2)
-	new.setHeader(old.Type(), old.Keys())
-	new.AppendRange(old, 0, 0, idx)                        // copy the keys before `idx`
-	new.AppendKV(idx, ptr, []byte{}, []byte{})             // update the ptr at idx
-	new.AppendRange(old, idx+1, idx+1, old.Keys()-(idx+1)) // copy keys after `idx`
-	return new
+func (old BNode) InsertValue(idx uint16, key []byte, val []byte) (BNode, error) {
+	entries, err := old.insertEntry(idx, entry{key: key, val: val})
+	if err != nil {
+		return nil, err
+	}
+	return buildNode(BNODE_LEAF, old.prefixed(), entries, len(old)), nil
 }
 
-func (old BNode) DeleteValue(idx uint16) BNode {
-	new := make(BNode, BTREE_PAGE_SIZE)
-	new.setHeader(BNODE_LEAF, old.Keys()-1)
-	new.AppendRange(old, 0, 0, idx)
-	new.AppendRange(old, idx, idx+1, old.Keys()-(idx+1))
-	return new
+func (old BNode) DeleteValue(idx uint16) (BNode, error) {
+	entries, err := old.entries(0, idx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err = old.appendEntries(entries, idx+1, old.Keys())
+	if err != nil {
+		return nil, err
+	}
+	return buildNode(BNODE_LEAF, old.prefixed(), entries, len(old)), nil
 }
 
 func (old BNode) UpdateValue(
 	idx uint16, key []byte, val []byte,
-) BNode {
-	new := make(BNode, BTREE_PAGE_SIZE)
-	new.setHeader(BNODE_LEAF, old.Keys())
-	new.AppendRange(old, 0, 0, idx)
-	new.AppendKV(idx, 0, key, val)
-	new.AppendRange(old, idx+1, idx+1, old.Keys()-(idx+1))
-	return new
+) (BNode, error) {
+	entries, err := old.updateEntry(idx, entry{key: key, val: val})
+	if err != nil {
+		return nil, err
+	}
+	return buildNode(BNODE_LEAF, old.prefixed(), entries, len(old)), nil
 }
 
-func (new BNode) AppendRange(old BNode, dstNew uint16, srcOld uint16, n uint16) error {
-	for i := range n {
-		dst, src := dstNew+i, srcOld+i
-		srcPtr, err := old.getPtr(src)
-		if err != nil {
-			return err
-		}
-		srcKey, err := old.getKey(src)
-		if err != nil {
-			return err
-		}
-		srcVal, err := old.getVal(src)
-		if err != nil {
-			return err
-		}
-		err = new.AppendKV(dst, srcPtr, srcKey, srcVal)
-		if err != nil {
-			return err
-		}
+func (old BNode) insertEntry(idx uint16, e entry) ([]entry, error) {
+	entries, err := old.entries(0, idx)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	entries = append(entries, e)
+	return old.appendEntries(entries, idx, old.Keys())
 }
 
-func (node BNode) LookupLE(key []byte) (uint16, error) {
-	nkeys := node.Keys()
-	var i uint16
-	for i = range nkeys {
-		currentKey, err := node.getKey(i)
-		if err != nil {
-			return 0, err
-		}
-		cmp := bytes.Compare(currentKey, key)
-		if cmp == 0 {
-			return i, nil
-		}
-		if cmp > 0 {
-			// Key is smaller than current key
-			if i == 0 {
-				// Key is smaller than all keys, return first pointer (index 0)
-				return 0, nil
-			}
-			return i - 1, nil
-		}
+func (old BNode) updateEntry(idx uint16, e entry) ([]entry, error) {
+	entries, err := old.entries(0, idx)
+	if err != nil {
+		return nil, err
 	}
-	// Key is larger than or equal to all keys, return last index
-	return nkeys - 1, nil
+	entries = append(entries, e)
+	return old.appendEntries(entries, idx+1, old.Keys())
 }
 
-func (node BNode) Lookup(key []byte) (uint16, bool, error) {
-	nkeys := node.Keys()
-	var i uint16
-	for i = range nkeys {
-		currentKey, err := node.getKey(i)
+// ReplaceKids replaces the n children starting at idx with kids. The kids
+// are written to storage and keyed by their first key. The result is split
+// into page sized nodes.
+func (old BNode) ReplaceKids(idx uint16, n uint16, kids []BNode, storage Storage) ([]BNode, error) {
+	entries, err := old.entries(0, idx) // the keys before `idx`
+	if err != nil {
+		return nil, err
+	}
+	new, err := kidEntries(kids, storage)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, new...)
+	entries, err = old.appendEntries(entries, idx+n, old.Keys()) // the keys after the replaced ones
+	if err != nil {
+		return nil, err
+	}
+	return pack(BNODE_NODE, false, entries, storage.PageSize()), nil
+}
+
+// kidEntries writes kids to storage and returns their entries for the parent
+func kidEntries(kids []BNode, storage Storage) ([]entry, error) {
+	entries := make([]entry, 0, len(kids))
+	for _, kid := range kids {
+		ptr, err := storage.New(kid)
 		if err != nil {
-			return 0, false, err
-		}
-		cmp := bytes.Compare(currentKey, key)
-		if cmp == 0 {
-			return i, true, nil
+			return nil, err
 		}
-		if cmp > 0 {
-			// Key should be inserted before this key
-			return i, false, nil
+		key, err := kid.getKey(0)
+		if err != nil {
+			return nil, err
 		}
+		entries = append(entries, entry{key: key, ptr: ptr})
 	}
-	// Key is larger than all existing keys, insert at the end
-	return nkeys, false, nil
+	return entries, nil
 }
 
-func (node BNode) Split() (BNode, BNode) {
-	nleft := node.Keys() / 2
-	nright := node.Keys() - nleft
-
-	left, right := make(BNode, BTREE_PAGE_SIZE*2), make(BNode, BTREE_PAGE_SIZE*2)
-	left.setHeader(BNODE_LEAF, nleft)
-	right.setHeader(BNODE_LEAF, nright)
+// entry is a single key of a node while the node is rebuilt
+type entry struct {
+	key []byte
+	ptr uint64
+	val []byte
+}
 
-	left.AppendRange(node, 0, 0, nleft)
-	right.AppendRange(node, 0, nleft, nright)
+// size is what the entry takes in a node of the default format
+func (e entry) size() int {
+	return 8 + 2 + HEADER + len(e.key) + len(e.val)
+}
 
-	return left, right
+func (node BNode) entries(from, to uint16) ([]entry, error) {
+	return node.appendEntries(make([]entry, 0, node.Keys()+1), from, to)
 }
 
-// splitIfNeeded splits a node if it exceeds page size and returns the result node
-func (node BNode) splitIfNeeded(storage Storage) (BNode, error) {
-	bytes, err := node.usedBytes()
-	if err != nil {
-		return nil, err
+func (node BNode) appendEntries(entries []entry, from, to uint16) ([]entry, error) {
+	for i := from; i < to; i++ {
+		ptr, err := node.getPtr(i)
+		if err != nil {
+			return nil, err
+		}
+		key, err := node.getKey(i)
+		if err != nil {
+			return nil, err
+		}
+		val, err := node.getVal(i)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: key, ptr: ptr, val: val})
 	}
+	return entries, nil
+}
 
-	if bytes < BTREE_PAGE_SIZE {
-		return node[:BTREE_PAGE_SIZE], nil
+// nodeSize returns the bytes a node holding entries takes
+func nodeSize(prefixed bool, entries []entry) int {
+	if prefixed {
+		return prefixedSize(entries)
 	}
-
-	// Node is too large - need to split
-	return node.splitLarge(storage)
+	size := HEADER
+	for _, e := range entries {
+		size += e.size()
+	}
+	return size
 }
 
-// splitLarge splits an oversized node into multiple children and creates a parent
-func (node BNode) splitLarge(storage Storage) (BNode, error) {
-	nodes := []BNode{}
-	left, right := node.Split()
-
-	leftSize, err := left.usedBytes()
-	if err != nil {
-		return nil, err
+// buildNode writes entries into a new node. The node is at least a page
+// large, or larger if the entries need it.
+func buildNode(btype Type, prefixed bool, entries []entry, pageSize int) BNode {
+	new := BNode(make([]byte, max(pageSize, nodeSize(prefixed, entries))))
+	new.setHeader(btype, uint16(len(entries)))
+	if prefixed {
+		new.setPrefix(sharedPrefix(entries))
 	}
-	rightSize, err := right.usedBytes()
-	if err != nil {
-		return nil, err
+	for i, e := range entries {
+		new.AppendKV(uint16(i), e.ptr, e.key, e.val)
 	}
+	return new
+}
 
-	// Check if left child needs further splitting
-	if leftSize > BTREE_PAGE_SIZE {
-		l1, l2 := left.Split()
-		nodes = append(nodes, l1[:BTREE_PAGE_SIZE])
-		nodes = append(nodes, l2[:BTREE_PAGE_SIZE])
-	} else {
-		nodes = append(nodes, left[:BTREE_PAGE_SIZE])
+// pack writes entries into as many page sized nodes as they need, splitting
+// them into halves of similar size.
+func pack(btype Type, prefixed bool, entries []entry, pageSize int) []BNode {
+	if len(entries) <= 1 || nodeSize(prefixed, entries) <= nodeCap(pageSize) {
+		return []BNode{buildNode(btype, prefixed, entries, pageSize)}
 	}
+	left, right := splitEntries(entries)
+	return append(pack(btype, prefixed, left, pageSize), pack(btype, prefixed, right, pageSize)...)
+}
 
-	// Check if right child needs further splitting
-	if rightSize > BTREE_PAGE_SIZE {
-		r1, r2 := right.Split()
-		nodes = append(nodes, r1[:BTREE_PAGE_SIZE])
-		nodes = append(nodes, r2[:BTREE_PAGE_SIZE])
-	} else {
-		nodes = append(nodes, right[:BTREE_PAGE_SIZE])
+// splitEntries divides entries where the bytes of both halves are closest
+func splitEntries(entries []entry) ([]entry, []entry) {
+	total := 0
+	for _, e := range entries {
+		total += e.size()
 	}
+	best, bestDiff, left := 1, -1, 0
+	for i := 1; i < len(entries); i++ {
+		left += entries[i-1].size()
+		diff := max(2*left-total, total-2*left)
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = i, diff
+		}
+	}
+	return entries[:best], entries[best:]
+}
 
-	// Create parent node with all split children
-	result := BNode(make([]byte, BTREE_PAGE_SIZE))
-	result.setHeader(BNODE_NODE, uint16(len(nodes)))
+// Split divides the node into two halves of similar size
+func (node BNode) Split() (BNode, BNode, error) {
+	entries, err := node.entries(0, node.Keys())
+	if err != nil {
+		return nil, nil, err
+	}
+	left, right := splitEntries(entries)
+	return buildNode(node.Type(), node.prefixed(), left, len(node)), buildNode(node.Type(), node.prefixed(), right, len(node)), nil
+}
 
-	for i, v := range nodes {
-		ptr, err := storage.New(v)
+// LookupLE returns the index of the last key less than or equal to key, or 0
+// if all keys are larger.
+func (node BNode) LookupLE(key []byte) (uint16, error) {
+	// Binary search for the first key greater than key
+	lo, hi := uint16(0), node.Keys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		cmp, err := node.compareKey(mid, key)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		key, err := v.getKey(0)
-		if err != nil {
-			return nil, err
+		if cmp <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
-		result.AppendKV(uint16(i), ptr, key, nil)
 	}
+	if lo == 0 {
+		// Key is smaller than all keys, return first pointer (index 0)
+		return 0, nil
+	}
+	return lo - 1, nil
+}
 
-	if len(result) > BTREE_PAGE_SIZE {
-		return nil, fmt.Errorf("size too large after split")
+// Lookup returns the index of key and true if it exists, otherwise the index
+// it has to be inserted at.
+func (node BNode) Lookup(key []byte) (uint16, bool, error) {
+	// Binary search for the first key greater than or equal to key
+	nkeys := node.Keys()
+	lo, hi := uint16(0), nkeys
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		cmp, err := node.compareKey(mid, key)
+		if err != nil {
+			return 0, false, err
+		}
+		if cmp < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == nkeys {
+		// Key is larger than all existing keys, insert at the end
+		return nkeys, false, nil
+	}
+	cmp, err := node.compareKey(lo, key)
+	if err != nil {
+		return 0, false, err
 	}
-	return result[:BTREE_PAGE_SIZE], nil
+	return lo, cmp == 0, nil
 }
 
 // insertIntoInternal handles insertion into an internal node
-func (node BNode) insertIntoInternal(key []byte, val []byte, storage Storage) (BNode, error) {
+func (node BNode) insertIntoInternal(key []byte, valPtr uint64, val []byte, storage Storage) ([]BNode, error) {
 	idx, err := node.LookupLE(key)
 	if err != nil {
 		return nil, err
@@ -638,39 +1035,38 @@ func (node BNode) insertIntoInternal(key []byte, val []byte, storage Storage) (B
 	}
 
 	child := BNode(data)
-	newChild, err := child.Insert(key, val, storage)
-	if err != nil {
-		return nil, err
-	}
-
-	// Store new child and mark old for deletion
-	newChildPtr, err := storage.New(newChild)
+	kids, err := child.Insert(key, valPtr, val, storage)
 	if err != nil {
 		return nil, err
 	}
 	storage.Delete(ptr)
 
-	// Update the child pointer at this index
-	new := node.UpdatePtr(idx, newChildPtr)
-
-	// Split if needed
-	return new.splitIfNeeded(storage)
+	// Replace the child with its split parts
+	return node.ReplaceKids(idx, 1, kids, storage)
 }
 
 // insertIntoLeaf handles insertion into a leaf node
-func (node BNode) insertIntoLeaf(key []byte, val []byte, storage Storage) (BNode, error) {
+func (node BNode) insertIntoLeaf(key []byte, ptr uint64, val []byte, storage Storage) ([]BNode, error) {
 	idx, ok, err := node.Lookup(key)
 	if err != nil {
 		return nil, err
 	}
 
-	var new BNode
-	if ok {
-		new = node.UpdateValue(idx, key, val)
-	} else {
-		new = node.InsertValue(idx, key, val)
+	e := entry{key: key, ptr: ptr, val: val}
+	if !ok {
+		entries, err := node.insertEntry(idx, e)
+		if err != nil {
+			return nil, err
+		}
+		return pack(BNODE_LEAF, node.prefixed(), entries, storage.PageSize()), nil
 	}
-
-	// Split if needed
-	return new.splitIfNeeded(storage)
+	entries, err := node.updateEntry(idx, e)
+	if err != nil {
+		return nil, err
+	}
+	// The old value's overflow pages are not referenced anymore
+	if err := node.freeLeafValue(idx, storage); err != nil {
+		return nil, err
+	}
+	return pack(BNODE_LEAF, node.prefixed(), entries, storage.PageSize()), nil
 }
@@ -3,6 +3,8 @@ package storage
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -53,7 +55,10 @@ func TestInsertValue(t *testing.T) {
 	old.AppendKV(0, 0, []byte("k1"), []byte("hi"))
 	old.AppendKV(1, 0, []byte("k3"), []byte("hello"))
 
-	new := old.InsertValue(1, []byte("k2"), []byte("world"))
+	new, err := old.InsertValue(1, []byte("k2"), []byte("world"))
+	if err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
 
 	assertKV(t, new, 0, []byte("k1"), []byte("hi"))
 	assertKV(t, new, 1, []byte("k2"), []byte("world"))
@@ -67,7 +72,10 @@ func TestUpdateValue(t *testing.T) {
 	old.AppendKV(1, 0, []byte("k2"), []byte("world"))
 	old.AppendKV(2, 0, []byte("k3"), []byte("hello"))
 
-	new := old.UpdateValue(1, []byte("k2"), []byte("Erde"))
+	new, err := old.UpdateValue(1, []byte("k2"), []byte("Erde"))
+	if err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
 
 	assertKV(t, new, 0, []byte("k1"), []byte("hi"))
 	assertKV(t, new, 1, []byte("k2"), []byte("Erde"))
@@ -96,7 +104,10 @@ func TestSplit(t *testing.T) {
 	node.AppendKV(0, 0, []byte("k1"), []byte("hi"))
 	node.AppendKV(1, 0, []byte("k3"), []byte("hello"))
 
-	left, right := node.Split()
+	left, right, err := node.Split()
+	if err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
 
 	assertKV(t, left, 0, []byte("k1"), []byte("hi"))
 	assertKV(t, right, 0, []byte("k3"), []byte("hello"))
@@ -177,18 +188,121 @@ func TestInsertTooLargeKey(t *testing.T) {
 	}
 }
 
-func TestInsertTooLargeValue(t *testing.T) {
-	tree, _ := NewBTree(
-		&MockStorage{
-			testing: t,
-			storage: map[uint64][]byte{},
-		},
-		NewMetadata(make([]byte, BTREE_PAGE_SIZE)),
-	)
-	err := tree.Insert([]byte("hello"), []byte(strings.Repeat("a", 3001)))
-	if err == nil {
+func TestInsertLargeValue(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	val := []byte(strings.Repeat("abcdefgh", 5000))
+	err := tree.Insert([]byte("hello"), val)
+	if err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
+	tree.Insert([]byte("hallo"), []byte("welt"))
+
+	// 40000 bytes need 10 overflow pages next to the root
+	if len(storage.storage) != 11 {
+		t.Fatalf("should have 11 pages, has: %d", len(storage.storage))
+	}
+
+	result, ok, err := tree.Get([]byte("hello"))
+	if err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
+	if !ok || !bytes.Equal(result, val) {
+		t.Fatalf("value mismatch, got %d bytes", len(result))
+	}
+
+	count := 0
+	for key, value := range tree.All() {
+		if string(key) == "hello" && !bytes.Equal(value, val) {
+			t.Fatalf("scan value mismatch, got %d bytes", len(value))
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("got the count wrong should: 2, is: %d", count)
+	}
+}
+
+func TestUpdateAndDeleteLargeValueFreesPages(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	tree.Insert([]byte("hello"), []byte(strings.Repeat("a", 20000)))
+	tree.Insert([]byte("hello"), []byte(strings.Repeat("b", 10000)))
+	if len(storage.storage) != 4 {
+		t.Fatalf("old overflow pages should be freed, has: %d pages", len(storage.storage))
+	}
+
+	// Back to an inline value
+	tree.Insert([]byte("hello"), []byte("world"))
+	if len(storage.storage) != 1 {
+		t.Fatalf("old overflow pages should be freed, has: %d pages", len(storage.storage))
+	}
+	result, _, _ := tree.Get([]byte("hello"))
+	if !bytes.Equal(result, []byte("world")) {
+		t.Fatalf("value mismatch got %s, want %s", result, "world")
+	}
+
+	tree.Insert([]byte("hello"), []byte(strings.Repeat("c", 10000)))
+	if err := tree.Delete([]byte("hello")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if len(storage.storage) != 1 {
+		t.Fatalf("overflow pages should be freed, has: %d pages", len(storage.storage))
+	}
+}
+
+// brokenStorage fails to read a single page
+type brokenStorage struct {
+	*MockStorage
+	broken uint64
+}
+
+func (b *brokenStorage) Get(ptr uint64) ([]byte, error) {
+	if ptr == b.broken {
+		return nil, fmt.Errorf("page %d is broken", ptr)
+	}
+	return b.MockStorage.Get(ptr)
+}
+
+func TestFailedInsertFreesOverflowPages(t *testing.T) {
+	storage := &brokenStorage{MockStorage: &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	for i := range 10 {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := tree.Insert(key, []byte(strings.Repeat("v", 1000))); err != nil {
+			t.Fatalf("should not raised err: %v", err)
+		}
+	}
+	data, _ := storage.Get(tree.metaData.Root)
+	root := BNode(data)
+	if root.Type() != BNODE_NODE {
+		t.Fatalf("root should be an internal node")
+	}
+	storage.broken, _ = root.getPtr(0)
+
+	pages := len(storage.storage)
+	if err := tree.Insert([]byte("key"), []byte(strings.Repeat("a", 20000))); err == nil {
 		t.Fatal("should raised err")
 	}
+	if len(storage.storage) != pages {
+		t.Fatalf("overflow pages should be freed, has: %d pages, want: %d", len(storage.storage), pages)
+	}
+	data, _ = storage.Get(tree.metaData.Root)
+	if !bytes.Equal(data, root) {
+		t.Fatalf("root should not change")
+	}
 }
 
 func TestInsertTooForceSplit(t *testing.T) {
@@ -472,3 +586,636 @@ func TestScan(t *testing.T) {
 	}
 
 }
+
+// checkTree walks the whole tree and verifies key order, separator keys,
+// node sizes and that only the root may be empty. It returns the height.
+func checkTree(t *testing.T, tree BTree) int {
+	t.Helper()
+	height, _ := checkNode(t, tree, tree.metaData.Root, true)
+	return height
+}
+
+func checkNode(t *testing.T, tree BTree, ptr uint64, root bool) (int, []byte) {
+	t.Helper()
+	data, err := tree.storage.Get(ptr)
+	if err != nil {
+		t.Fatalf("failed to get page %d: %v", ptr, err)
+	}
+	node := BNode(data)
+	if node.Keys() == 0 {
+		if !root || node.Type() != BNODE_LEAF {
+			t.Fatalf("page %d is empty", ptr)
+		}
+		return 1, nil
+	}
+	used, err := node.usedBytes()
+	if err != nil || int(used) > nodeCap(tree.storage.PageSize()) {
+		t.Fatalf("page %d is too large: %d bytes", ptr, used)
+	}
+	if len(node) != tree.storage.PageSize() {
+		t.Fatalf("page %d has %d bytes instead of a page", ptr, len(node))
+	}
+
+	var prev []byte
+	height := 0
+	for i := uint16(0); i < node.Keys(); i++ {
+		key, _ := node.getKey(i)
+		if i > 0 && bytes.Compare(prev, key) >= 0 {
+			t.Fatalf("page %d keys out of order at %d", ptr, i)
+		}
+		prev = key
+
+		if node.Type() == BNODE_NODE {
+			kid, _ := node.getPtr(i)
+			h, first := checkNode(t, tree, kid, false)
+			if !bytes.Equal(first, key) {
+				t.Fatalf("page %d separator %d does not match first key of child", ptr, i)
+			}
+			if height != 0 && h != height {
+				t.Fatalf("page %d children have different heights", ptr)
+			}
+			height = h
+		}
+	}
+	first, _ := node.getKey(0)
+	return height + 1, first
+}
+
+func TestDeleteMergesNodes(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	val := []byte(strings.Repeat("v", 100))
+	// long keys keep the fan-out small so the tree gets a few levels
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%05d-%s", i, strings.Repeat("k", 90)))
+	}
+	for i := range 2000 {
+		if err := tree.Insert(key(i), val); err != nil {
+			t.Fatalf("insert %d failed: %v", i, err)
+		}
+	}
+	fullPages := len(storage.storage)
+	fullHeight := checkTree(t, tree)
+	if fullHeight < 3 {
+		t.Fatalf("tree should have at least 3 levels, has %d", fullHeight)
+	}
+
+	// Keep every 50th key
+	for i := range 2000 {
+		if i%50 == 0 {
+			continue
+		}
+		if err := tree.Delete(key(i)); err != nil {
+			t.Fatalf("delete %d failed: %v", i, err)
+		}
+		if i%100 == 1 {
+			checkTree(t, tree)
+		}
+	}
+	height := checkTree(t, tree)
+
+	if len(storage.storage) >= fullPages/10 {
+		t.Fatalf("pages should be merged, has %d of %d", len(storage.storage), fullPages)
+	}
+	if height >= fullHeight {
+		t.Fatalf("tree should shrink, height %d of %d", height, fullHeight)
+	}
+
+	count := 0
+	for k := range tree.All() {
+		if !bytes.Equal(k, key(count*50)) {
+			t.Fatalf("unexpected key %s, want %s", k, key(count*50))
+		}
+		count++
+	}
+	if count != 40 {
+		t.Fatalf("got the count wrong should: 40, is: %d", count)
+	}
+}
+
+func TestDeleteAllShrinksRoot(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	for i := range 5 {
+		key := []byte(strings.Repeat(string(rune('a'+i)), 1000))
+		val := []byte(strings.Repeat(string(rune('a'+i)), 3000))
+		if err := tree.Insert(key, val); err != nil {
+			t.Fatalf("insert %d failed: %v", i, err)
+		}
+	}
+	for i := range 5 {
+		key := []byte(strings.Repeat(string(rune('a'+i)), 1000))
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("delete %d failed: %v", i, err)
+		}
+		checkTree(t, tree)
+	}
+
+	if len(storage.storage) != 1 {
+		t.Fatalf("should only have the root page, has: %d", len(storage.storage))
+	}
+	data, _ := storage.Get(tree.metaData.Root)
+	root := BNode(data)
+	if root.Type() != BNODE_LEAF || root.Keys() != 0 {
+		t.Fatalf("root should be an empty leaf, is type %d with %d keys", root.Type(), root.Keys())
+	}
+}
+
+func TestDeleteBorrowsFromSibling(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+
+	// A full left leaf and an underfull right one, together they don't fit a page
+	left := make(BNode, BTREE_PAGE_SIZE)
+	left.setHeader(BNODE_LEAF, 3)
+	for i := range uint16(3) {
+		left.AppendKV(i, 0, []byte{'a', byte(i)}, []byte(strings.Repeat("x", 1300)))
+	}
+	right := make(BNode, BTREE_PAGE_SIZE)
+	right.setHeader(BNODE_LEAF, 1)
+	right.AppendKV(0, 0, []byte{'b'}, []byte(strings.Repeat("y", 500)))
+
+	leftPtr, _ := storage.New(left)
+	rightPtr, _ := storage.New(right)
+	parent := make(BNode, BTREE_PAGE_SIZE)
+	parent.setHeader(BNODE_NODE, 2)
+	parent.AppendKV(0, leftPtr, []byte{'a', 0}, nil)
+	parent.AppendKV(1, rightPtr, []byte{'b'}, nil)
+
+	nodes, err := parent.rebalance(1, []BNode{right}, storage)
+	if err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+	new := nodes[0]
+	if new.Keys() != 2 {
+		t.Fatalf("should keep two children, has: %d", new.Keys())
+	}
+
+	ptr, _ := new.getPtr(1)
+	data, _ := storage.Get(ptr)
+	kid := BNode(data)
+	if kid.Keys() != 2 {
+		t.Fatalf("right child should borrow a key, has: %d", kid.Keys())
+	}
+	assertKV(t, kid, 0, []byte{'a', 2}, []byte(strings.Repeat("x", 1300)))
+	separator, _ := new.getKey(1)
+	if !bytes.Equal(separator, []byte{'a', 2}) {
+		t.Fatalf("separator should be updated, is: %v", separator)
+	}
+}
+
+func TestDeleteMissingKeyKeepsTree(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+	tree.Insert([]byte("hello"), []byte("world"))
+
+	root := tree.metaData.Root
+	if err := tree.Delete([]byte("servus")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if tree.metaData.Root != root {
+		t.Fatal("deleting a missing key should not rewrite the tree")
+	}
+}
+
+// fullLeaf builds a leaf filled with small keys "k00000", "k00002", ...
+func fullLeaf() BNode {
+	var keys [][]byte
+	size := HEADER
+	for i := 0; ; i += 2 {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		if size+8+2+HEADER+len(key) > BTREE_PAGE_SIZE {
+			break
+		}
+		size += 8 + 2 + HEADER + len(key)
+		keys = append(keys, key)
+	}
+
+	node := make(BNode, BTREE_PAGE_SIZE)
+	node.setHeader(BNODE_LEAF, uint16(len(keys)))
+	for i, key := range keys {
+		node.AppendKV(uint16(i), 0, key, nil)
+	}
+	return node
+}
+
+// lookupLinear is the reference linear scan the binary search replaced
+func lookupLinear(node BNode, key []byte) (uint16, bool) {
+	for i := range node.Keys() {
+		currentKey, _ := node.getKey(i)
+		cmp := bytes.Compare(currentKey, key)
+		if cmp == 0 {
+			return i, true
+		}
+		if cmp > 0 {
+			return i, false
+		}
+	}
+	return node.Keys(), false
+}
+
+func TestLookupMatchesLinearScan(t *testing.T) {
+	node := fullLeaf()
+	nkeys := int(node.Keys())
+	for i := -1; i <= 2*nkeys+1; i++ {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		if i < 0 {
+			key = []byte("a")
+		}
+
+		wantIdx, wantOk := lookupLinear(node, key)
+		idx, ok, err := node.Lookup(key)
+		if err != nil {
+			t.Fatalf("should not raised err: %v", err)
+		}
+		if idx != wantIdx || ok != wantOk {
+			t.Fatalf("Lookup(%s) = %d, %v, want %d, %v", key, idx, ok, wantIdx, wantOk)
+		}
+
+		wantLE := wantIdx
+		if !wantOk && wantLE > 0 {
+			wantLE--
+		}
+		le, err := node.LookupLE(key)
+		if err != nil {
+			t.Fatalf("should not raised err: %v", err)
+		}
+		if le != wantLE {
+			t.Fatalf("LookupLE(%s) = %d, want %d", key, le, wantLE)
+		}
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	node := fullLeaf()
+	keys := make([][]byte, node.Keys())
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("k%05d", 2*i+1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		node.Lookup(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkLookupLinear(b *testing.B) {
+	node := fullLeaf()
+	keys := make([][]byte, node.Keys())
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("k%05d", 2*i+1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookupLinear(node, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkLookupLE(b *testing.B) {
+	node := fullLeaf()
+	keys := make([][]byte, node.Keys())
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("k%05d", 2*i+1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		node.LookupLE(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkTreeGet(b *testing.B) {
+	db := &MMapStorage{Path: filepath.Join(b.TempDir(), "bench.db")}
+	if err := db.Open(); err != nil {
+		b.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("k%05d", i))
+		db.tree.Insert(keys[i], nil)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.tree.Get(keys[i%len(keys)])
+	}
+}
+
+func prefixedMetadata() *Metadata {
+	metadata := NewMetadata(make([]byte, BTREE_PAGE_SIZE))
+	metadata.Flags = FORMAT_PREFIX_LEAVES
+	return metadata
+}
+
+func TestPrefixedWriteAndRead(t *testing.T) {
+	node := buildNode(BNODE_LEAF, true, []entry{
+		{key: []byte("table-k1"), val: []byte("hi")},
+		{key: []byte("table-k3"), val: []byte("hello")},
+		{key: []byte("table-k5"), ptr: 42, val: []byte("12345678")},
+	}, BTREE_PAGE_SIZE)
+
+	if !node.prefixed() || node.Type() != BNODE_LEAF {
+		t.Fatalf("should be a prefixed leaf, type is: %d", node.Type())
+	}
+	if !bytes.Equal(node.prefix(), []byte("table-k")) {
+		t.Fatalf("wrong prefix: %s", node.prefix())
+	}
+	assertKV(t, node, 0, []byte("table-k1"), []byte("hi"))
+	assertKV(t, node, 1, []byte("table-k3"), []byte("hello"))
+	assertKV(t, node, 2, []byte("table-k5"), []byte("12345678"))
+	if ptr, _ := node.getPtr(2); ptr != 42 {
+		t.Fatalf("overflow pointer should be kept, got: %d", ptr)
+	}
+	if ptr, _ := node.getPtr(1); ptr != 0 {
+		t.Fatalf("inline value should have no pointer, got: %d", ptr)
+	}
+
+	for _, tc := range []struct {
+		key string
+		idx uint16
+		ok  bool
+	}{
+		{"a", 0, false},
+		{"table-", 0, false},
+		{"table-k1", 0, true},
+		{"table-k2", 1, false},
+		{"table-k5", 2, true},
+		{"table-k6", 3, false},
+		{"z", 3, false},
+	} {
+		idx, ok, err := node.Lookup([]byte(tc.key))
+		if err != nil {
+			t.Fatalf("should not raised err: %v", err)
+		}
+		if idx != tc.idx || ok != tc.ok {
+			t.Fatalf("Lookup(%s) = %d, %v, want %d, %v", tc.key, idx, ok, tc.idx, tc.ok)
+		}
+	}
+}
+
+func TestPrefixedLeavesFitMoreKeys(t *testing.T) {
+	plain := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	prefixed := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	plainTree, _ := NewBTree(plain, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+	prefixedTree, _ := NewBTree(prefixed, prefixedMetadata())
+
+	// keys as written for a table with a composite primary key
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("\x64\x00\x00\x00customer-0042/order-%06d", i))
+	}
+	for i := range 3000 {
+		plainTree.Insert(key(i), []byte("v"))
+		prefixedTree.Insert(key(i), []byte("v"))
+	}
+	checkTree(t, plainTree)
+	checkTree(t, prefixedTree)
+
+	if 2*len(prefixed.storage) > len(plain.storage) {
+		t.Fatalf("prefixed leaves should need less than half the pages, has %d of %d", len(prefixed.storage), len(plain.storage))
+	}
+
+	for i := range 3000 {
+		val, ok, err := prefixedTree.Get(key(i))
+		if err != nil || !ok || !bytes.Equal(val, []byte("v")) {
+			t.Fatalf("failed to get key %d: %v, ok=%v", i, err, ok)
+		}
+	}
+	count := 0
+	for k := range prefixedTree.Scan(key(1000), key(2000)) {
+		if !bytes.Equal(k, key(1000+count)) {
+			t.Fatalf("unexpected key %s", k)
+		}
+		count++
+	}
+	if count != 1000 {
+		t.Fatalf("got the count wrong should: 1000, is: %d", count)
+	}
+
+	for i := range 3000 {
+		if err := prefixedTree.Delete(key(i)); err != nil {
+			t.Fatalf("delete %d failed: %v", i, err)
+		}
+	}
+	checkTree(t, prefixedTree)
+	if len(prefixed.storage) != 1 {
+		t.Fatalf("should only have the root page, has: %d", len(prefixed.storage))
+	}
+}
+
+func TestPrefixedLeafPrefixShrinks(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, prefixedMetadata())
+
+	// a long shared prefix lets a lot of keys fit into a single leaf
+	long := strings.Repeat("p", 900)
+	for i := range 300 {
+		tree.Insert([]byte(fmt.Sprintf("%s%03d", long, i)), nil)
+	}
+	checkTree(t, tree)
+
+	// a key without that prefix would blow the leaf up to far more than a page
+	if err := tree.Insert([]byte("a"), []byte("first")); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	checkTree(t, tree)
+
+	val, ok, err := tree.Get([]byte("a"))
+	if err != nil || !ok || !bytes.Equal(val, []byte("first")) {
+		t.Fatalf("failed to get key: %v, ok=%v", err, ok)
+	}
+	count := 0
+	for range tree.All() {
+		count++
+	}
+	if count != 301 {
+		t.Fatalf("got the count wrong should: 301, is: %d", count)
+	}
+}
+
+func TestPrefixedLeafLargeValue(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, prefixedMetadata())
+
+	val := []byte(strings.Repeat("abcdefgh", 2000))
+	tree.Insert([]byte("key-1"), []byte("small"))
+	tree.Insert([]byte("key-2"), val)
+	tree.Insert([]byte("key-3"), []byte("small"))
+
+	result, ok, err := tree.Get([]byte("key-2"))
+	if err != nil || !ok || !bytes.Equal(result, val) {
+		t.Fatalf("failed to get large value: %v, ok=%v, %d bytes", err, ok, len(result))
+	}
+
+	if err := tree.Delete([]byte("key-2")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if len(storage.storage) != 1 {
+		t.Fatalf("overflow pages should be freed, has: %d pages", len(storage.storage))
+	}
+}
+
+func TestLargerPageSizes(t *testing.T) {
+	for _, pageSize := range []int{8192, 16384, 65536} {
+		for _, prefixed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d/prefixed=%v", pageSize, prefixed), func(t *testing.T) {
+				storage := &MockStorage{
+					testing:  t,
+					storage:  map[uint64][]byte{},
+					pageSize: pageSize,
+				}
+				metadata := NewMetadata(make([]byte, META_SIZE))
+				if prefixed {
+					metadata.Flags = FORMAT_PREFIX_LEAVES
+				}
+				tree, _ := NewBTree(storage, metadata)
+
+				// keys and values at the limits fill the 16 bit offsets of 64K pages
+				bigKey := func(i int) []byte {
+					return []byte(fmt.Sprintf("%05d%s", i, strings.Repeat("k", maxKeySize(pageSize)-5)))
+				}
+				bigVal := []byte(strings.Repeat("v", maxValSize(pageSize)))
+				for i := range 20 {
+					if err := tree.Insert(bigKey(i), bigVal); err != nil {
+						t.Fatalf("insert %d failed: %v", i, err)
+					}
+				}
+				if err := tree.Insert(bigKey(20)[:maxKeySize(pageSize)], nil); err != nil {
+					t.Fatalf("largest key should fit: %v", err)
+				}
+				if err := tree.Insert([]byte(strings.Repeat("k", maxKeySize(pageSize)+1)), nil); err == nil {
+					t.Fatal("key above the limit should be rejected")
+				}
+				for i := range 2000 {
+					tree.Insert([]byte(fmt.Sprintf("key-%05d", i)), []byte("value"))
+				}
+				large := []byte(strings.Repeat("abcdefgh", pageSize/2))
+				tree.Insert([]byte("large"), large)
+				checkTree(t, tree)
+
+				for i := range 20 {
+					val, ok, err := tree.Get(bigKey(i))
+					if err != nil || !ok || !bytes.Equal(val, bigVal) {
+						t.Fatalf("failed to get key %d: %v, ok=%v", i, err, ok)
+					}
+				}
+				val, ok, err := tree.Get([]byte("large"))
+				if err != nil || !ok || !bytes.Equal(val, large) {
+					t.Fatalf("failed to get large value: %v, ok=%v", err, ok)
+				}
+
+				var keys [][]byte
+				for k := range tree.All() {
+					keys = append(keys, k)
+				}
+				for _, k := range keys {
+					if err := tree.Delete(k); err != nil {
+						t.Fatalf("delete failed: %v", err)
+					}
+				}
+				checkTree(t, tree)
+				if len(storage.storage) != 1 {
+					t.Fatalf("should only have the root page, has: %d", len(storage.storage))
+				}
+			})
+		}
+	}
+}
+
+func TestScanReverse(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	// every other key, so bounds can fall between keys; long keys for a few levels
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%04d-%s", i, strings.Repeat("k", 90)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		tree.Insert(key(i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if checkTree(t, tree) < 3 {
+		t.Fatal("tree should have at least 3 levels")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		lo, hi Bound
+		want   []int // first and last key, nil if empty
+	}{
+		{"open", Bound{}, Bound{}, []int{1998, 0}},
+		{"inclusive", Inclusive(key(100)), Inclusive(key(1500)), []int{1500, 100}},
+		{"exclusive", Exclusive(key(100)), Exclusive(key(1500)), []int{1498, 102}},
+		{"between keys", Inclusive(key(101)), Inclusive(key(1501)), []int{1500, 102}},
+		{"open low", Bound{}, Exclusive(key(600)), []int{598, 0}},
+		{"open high", Inclusive(key(600)), Bound{}, []int{1998, 600}},
+		{"single key", Inclusive(key(600)), Inclusive(key(600)), []int{600, 600}},
+		{"empty", Exclusive(key(600)), Exclusive(key(602)), nil},
+		{"inverted", Inclusive(key(900)), Inclusive(key(100)), nil},
+		{"below all", Bound{}, Exclusive(key(0)), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got [][]byte
+			for k, v := range tree.ScanReverse(tc.lo, tc.hi) {
+				var i int
+				fmt.Sscanf(string(k), "key-%d-", &i)
+				if string(v) != fmt.Sprintf("value%d", i) {
+					t.Fatalf("wrong value for %s: %s", k[:8], v)
+				}
+				got = append(got, k)
+			}
+			if tc.want == nil {
+				if len(got) != 0 {
+					t.Fatalf("should be empty, got %d keys", len(got))
+				}
+				return
+			}
+			count := (tc.want[0]-tc.want[1])/2 + 1
+			if len(got) != count {
+				t.Fatalf("got the count wrong should: %d, is: %d", count, len(got))
+			}
+			for i, k := range got {
+				if !bytes.Equal(k, key(tc.want[0]-2*i)) {
+					t.Fatalf("key %d should be %d, is: %s", i, tc.want[0]-2*i, k[:8])
+				}
+			}
+		})
+	}
+
+	// stopping early
+	count := 0
+	for range tree.ScanReverse(Bound{}, Bound{}) {
+		count++
+		if count == 10 {
+			break
+		}
+	}
+	if count != 10 {
+		t.Fatalf("got the count wrong should: 10, is: %d", count)
+	}
+}
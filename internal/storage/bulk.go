@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"sort"
+)
+
+// BulkLoad builds the tree bottom-up from sorted input instead of inserting
+// key by key. Every page is written once: leaves are packed in order up to
+// fill of a page, each full node becomes an entry of the level above. Keys
+// already in the tree are merged with the input, the input wins. A subtree
+// the input does not reach is kept as it is and becomes an entry of the
+// level above its root, so only the nodes on the way to the new keys are
+// written again.
+
+// The last full node of a level is held back until the next one is full.
+// The node a level ends with, at the end of the load or before a kept
+// subtree, is shared with the held back one if it is less than half full.
+
+var ErrUnsorted = errors.New("bulk load input is not sorted")
+
+// BulkLoad adds the keys of kvs, which must be strictly ascending, filling
+// nodes up to fill (0 < fill <= 1) of a page. On error the tree is not
+// changed.
+func (tree *BTree) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) error {
+	if !(0 < fill && fill <= 1) {
+		return fmt.Errorf("fill factor %v not in (0, 1]", fill)
+	}
+	pageSize := tree.storage.PageSize()
+	b := &bulkLoader{
+		storage:  tree.storage,
+		prefixed: tree.metaData.Flags&FORMAT_PREFIX_LEAVES != 0,
+		pageSize: pageSize,
+		limit:    int(fill * float64(nodeCap(pageSize))),
+	}
+
+	next, stop := iter.Pull2(kvs)
+	defer stop()
+	var prev []byte
+	input := func() (entry, bool, error) {
+		key, val, ok := next()
+		if !ok {
+			return entry{}, false, nil
+		}
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			return entry{}, false, ErrUnsorted
+		}
+		prev = key
+		e, err := b.entry(key, val)
+		return e, true, err
+	}
+	in, more, err := input()
+	if err != nil {
+		return err
+	}
+	// below reports if the next input key goes before hi, nil is no bound
+	below := func(hi []byte) bool {
+		return more && (hi == nil || bytes.Compare(in.key, hi) < 0)
+	}
+
+	// Merge the keys of the tree with the input, subtrees without input
+	// keys are kept
+	var old, chains []uint64
+	var merge func(ptr uint64, height int, key, hi []byte) error
+	merge = func(ptr uint64, height int, key, hi []byte) error {
+		if !below(hi) {
+			return b.keep(height, key, ptr)
+		}
+		data, err := tree.storage.Get(ptr)
+		if err != nil {
+			return err
+		}
+		node := BNode(data)
+		old = append(old, ptr)
+
+		if node.Type() == BNODE_NODE {
+			for i := uint16(0); i < node.Keys(); i++ {
+				kid, err := node.getPtr(i)
+				if err != nil {
+					return err
+				}
+				kidKey, err := node.getKey(i)
+				if err != nil {
+					return err
+				}
+				kidHi := hi
+				if i+1 < node.Keys() {
+					if kidHi, err = node.getKey(i + 1); err != nil {
+						return err
+					}
+				}
+				if err := merge(kid, height-1, kidKey, kidHi); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		entries, err := node.entries(0, node.Keys())
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			for below(e.key) {
+				if err := b.add(0, in); err != nil {
+					return err
+				}
+				if in, more, err = input(); err != nil {
+					return err
+				}
+			}
+			if more && bytes.Equal(in.key, e.key) {
+				// replaced, the old value's overflow pages are not referenced anymore
+				if e.ptr != 0 {
+					chains = append(chains, e.ptr)
+				}
+				continue
+			}
+			if err := b.add(0, e); err != nil {
+				return err
+			}
+		}
+		for below(hi) {
+			if err := b.add(0, in); err != nil {
+				return err
+			}
+			if in, more, err = input(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	height, err := tree.height()
+	if err != nil {
+		return err
+	}
+	if err := merge(tree.metaData.Root, height, nil, nil); err != nil {
+		return err
+	}
+
+	root, err := b.finish()
+	if err != nil {
+		return err
+	}
+	tree.metaData.Root = root
+
+	// Only delete old pages after root is safely updated
+	for _, ptr := range old {
+		if err := tree.storage.Delete(ptr); err != nil {
+			return err
+		}
+	}
+	for _, ptr := range chains {
+		if err := freeOverflow(ptr, tree.storage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// height returns the levels of the tree below the root, 0 for a leaf
+func (tree *BTree) height() (int, error) {
+	height := 0
+	for ptr := tree.metaData.Root; ; height++ {
+		data, err := tree.storage.Get(ptr)
+		if err != nil {
+			return 0, err
+		}
+		node := BNode(data)
+		if node.Type() == BNODE_LEAF {
+			return height, nil
+		}
+		if ptr, err = node.getPtr(0); err != nil {
+			return 0, err
+		}
+	}
+}
+
+type bulkLoader struct {
+	storage  Storage
+	prefixed bool
+	pageSize int
+	limit    int // bytes a node is filled up to
+	levels   []*bulkLevel
+}
+
+// bulkLevel is the node of a level that is filled at the moment and the
+// full one before it
+type bulkLevel struct {
+	held    []entry
+	entries []entry
+	raw     int // bytes of the entries without prefix compression
+}
+
+// entry turns an input pair into a leaf entry, large values are written to
+// overflow pages right away
+func (b *bulkLoader) entry(key, val []byte) (entry, error) {
+	if len(key) > maxKeySize(b.pageSize) {
+		return entry{}, fmt.Errorf("key to large")
+	}
+	if len(val) <= maxValSize(b.pageSize) {
+		return entry{key: key, val: val}, nil
+	}
+	ptr, err := writeOverflow(val, b.storage)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{key: key, ptr: ptr, val: binary.LittleEndian.AppendUint64(nil, uint64(len(val)))}, nil
+}
+
+// sizeWith returns the node size of the level once e is added and the new
+// value of raw
+func (l *bulkLevel) sizeWith(e entry, prefixed bool) (size, raw int) {
+	if !prefixed {
+		raw = l.raw + e.size()
+		return HEADER + raw, raw
+	}
+	raw = l.raw + 2 + HEADER + len(e.key) + len(e.val)
+	if e.ptr != 0 {
+		raw += 8
+	}
+	// the keys are sorted, so the prefix is the one of the first and the new key
+	prefix := len(e.key)
+	if len(l.entries) > 0 {
+		prefix = len(sharedPrefix([]entry{l.entries[0], e}))
+	}
+	n := len(l.entries) + 1
+	return HEADER + 2 + prefix + raw - n*prefix, raw
+}
+
+// add appends e to the node of a level, the node is held back first if e
+// does not fit anymore
+func (b *bulkLoader) add(level int, e entry) error {
+	for level >= len(b.levels) {
+		b.levels = append(b.levels, &bulkLevel{})
+	}
+	l := b.levels[level]
+	prefixed := b.prefixed && level == 0
+
+	size, _ := l.sizeWith(e, prefixed)
+	if len(l.entries) >= b.minKeys(level) && size > b.limit {
+		if l.held != nil {
+			if err := b.write(level, l.held); err != nil {
+				return err
+			}
+		}
+		l.held, l.entries, l.raw = l.entries, nil, 0
+	}
+	_, l.raw = l.sizeWith(e, prefixed)
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+// minKeys is the least number of keys a node of a level needs. Internal
+// nodes need two keys, or the tree would grow without end.
+func (b *bulkLoader) minKeys(level int) int {
+	if level > 0 {
+		return 2
+	}
+	return 1
+}
+
+// keep adds a subtree of the tree with the root at height, the levels below
+// are written first so the order is kept
+func (b *bulkLoader) keep(height int, key []byte, ptr uint64) error {
+	for level := 0; level <= height && level < len(b.levels); level++ {
+		if err := b.close(level); err != nil {
+			return err
+		}
+	}
+	return b.add(height+1, entry{key: key, ptr: ptr})
+}
+
+// close writes the held back node and the node of a level. If the last one
+// is less than half full the two are shared out, as one node if they fit.
+func (b *bulkLoader) close(level int) error {
+	l := b.levels[level]
+	held, entries := l.held, l.entries
+	l.held, l.entries, l.raw = nil, nil, 0
+
+	prefixed := b.prefixed && level == 0
+	if held != nil && (len(entries) < b.minKeys(level) || 2*nodeSize(prefixed, entries) < b.limit) {
+		entries = append(held, entries...)
+		held = nil
+		if len(entries) >= 2*b.minKeys(level) && nodeSize(prefixed, entries) > b.limit {
+			// the first split with the left node not smaller than the right one
+			i := sort.Search(len(entries), func(i int) bool {
+				return nodeSize(prefixed, entries[:i]) >= nodeSize(prefixed, entries[i:])
+			})
+			i = min(max(i, b.minKeys(level)), len(entries)-b.minKeys(level))
+			held, entries = entries[:i], entries[i:]
+		}
+	}
+	for _, node := range [][]entry{held, entries} {
+		if len(node) == 0 {
+			continue
+		}
+		if err := b.write(level, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes a node of a level and adds it to the level above
+func (b *bulkLoader) write(level int, entries []entry) error {
+	ptr, err := b.storage.New(b.build(level, entries))
+	if err != nil {
+		return err
+	}
+	return b.add(level+1, entry{key: entries[0].key, ptr: ptr})
+}
+
+func (b *bulkLoader) build(level int, entries []entry) BNode {
+	btype := BNODE_LEAF
+	if level > 0 {
+		btype = BNODE_NODE
+	}
+	return buildNode(btype, b.prefixed && level == 0, entries, b.pageSize)
+}
+
+// finish writes the nodes that are left and returns the root
+func (b *bulkLoader) finish() (uint64, error) {
+	if len(b.levels) == 0 {
+		return b.storage.New(buildNode(BNODE_LEAF, b.prefixed, nil, b.pageSize))
+	}
+	for level := 0; ; level++ {
+		l := b.levels[level]
+		if level < len(b.levels)-1 || l.held != nil {
+			if err := b.close(level); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if level > 0 && len(l.entries) == 1 {
+			// an internal root with a single child is that child
+			return l.entries[0].ptr, nil
+		}
+		return b.storage.New(b.build(level, l.entries))
+	}
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sortedInput yields the keys from..to-1, every step-th one
+func sortedInput(from, to, step int, val func(int) []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i := from; i < to; i += step {
+			if !yield([]byte(fmt.Sprintf("key-%06d", i)), val(i)) {
+				return
+			}
+		}
+	}
+}
+
+func smallValue(i int) []byte {
+	return []byte(fmt.Sprintf("value%d", i))
+}
+
+func countPages(t *testing.T, tree BTree, ptr uint64, btype Type) int {
+	data, _ := tree.storage.Get(ptr)
+	node := BNode(data)
+	if node.Type() == BNODE_LEAF {
+		if btype == BNODE_LEAF {
+			return 1
+		}
+		return 0
+	}
+	count := 0
+	if btype == BNODE_NODE {
+		count = 1
+	}
+	for i := range node.Keys() {
+		kid, _ := node.getPtr(i)
+		count += countPages(t, tree, kid, btype)
+	}
+	return count
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, prefixed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prefixed=%v", prefixed), func(t *testing.T) {
+			newTree := func() (BTree, *MockStorage) {
+				storage := &MockStorage{
+					testing: t,
+					storage: map[uint64][]byte{},
+				}
+				metadata := NewMetadata(make([]byte, META_SIZE))
+				if prefixed {
+					metadata.Flags = FORMAT_PREFIX_LEAVES
+				}
+				tree, _ := NewBTree(storage, metadata)
+				return tree, storage
+			}
+
+			tree, storage := newTree()
+			if err := tree.BulkLoad(sortedInput(0, 20000, 1, smallValue), 1); err != nil {
+				t.Fatalf("bulk load failed: %v", err)
+			}
+			checkTree(t, tree)
+			for i := range 20000 {
+				val, ok, err := tree.Get([]byte(fmt.Sprintf("key-%06d", i)))
+				if err != nil || !ok || !bytes.Equal(val, smallValue(i)) {
+					t.Fatalf("failed to get key %d: %v, ok=%v", i, err, ok)
+				}
+			}
+
+			inserted, _ := newTree()
+			for k, v := range sortedInput(0, 20000, 1, smallValue) {
+				inserted.Insert(k, v)
+			}
+			full := countPages(t, tree, tree.metaData.Root, BNODE_LEAF)
+			if 10*full > 6*countPages(t, inserted, inserted.metaData.Root, BNODE_LEAF) {
+				t.Fatalf("full leaves should need far fewer pages than inserts, has %d", full)
+			}
+			if len(storage.storage) != full+countPages(t, tree, tree.metaData.Root, BNODE_NODE) {
+				t.Fatal("all pages should be part of the tree")
+			}
+
+			half, _ := newTree()
+			if err := half.BulkLoad(sortedInput(0, 20000, 1, smallValue), 0.5); err != nil {
+				t.Fatalf("bulk load failed: %v", err)
+			}
+			checkTree(t, half)
+			if leaves := countPages(t, half, half.metaData.Root, BNODE_LEAF); 10*leaves < 18*full || 10*leaves > 22*full {
+				t.Fatalf("half filled leaves should need twice the pages, has %d of %d", leaves, full)
+			}
+		})
+	}
+}
+
+func TestBulkLoadMergesTree(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	large := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("%06d", i), 1000))
+	}
+	for k, v := range sortedInput(0, 3000, 3, large) {
+		tree.Insert(k, v)
+	}
+
+	// every other key, so some keys of the tree are replaced
+	if err := tree.BulkLoad(sortedInput(0, 3000, 2, smallValue), 0.8); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+	checkTree(t, tree)
+
+	count := 0
+	for k, v := range tree.Scan(nil, nil) {
+		var i int
+		fmt.Sscanf(string(k), "key-%d", &i)
+		want := smallValue(i)
+		if i%2 != 0 {
+			want = large(i)
+		}
+		if !bytes.Equal(v, want) {
+			t.Fatalf("wrong value for key %d", i)
+		}
+		count++
+	}
+	if count != 2000 {
+		t.Fatalf("got the count wrong should: 2000, is: %d", count)
+	}
+
+	// replaced values should free their overflow pages
+	overflow := 0
+	for _, page := range storage.storage {
+		if BNode(page).Type() == BNODE_OVERFLOW {
+			overflow++
+		}
+	}
+	if overflow != 500*2 {
+		t.Fatalf("should keep the overflow pages of 500 values, has: %d pages", overflow)
+	}
+}
+
+func TestBulkLoadUnsorted(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+	tree.Insert([]byte("key"), []byte("value"))
+	root := tree.metaData.Root
+
+	for name, input := range map[string]iter.Seq2[[]byte, []byte]{
+		"descending": func(yield func([]byte, []byte) bool) {
+			_ = yield([]byte("c"), nil) && yield([]byte("b"), nil)
+		},
+		"duplicate": func(yield func([]byte, []byte) bool) {
+			_ = yield([]byte("a"), nil) && yield([]byte("b"), nil) && yield([]byte("b"), nil)
+		},
+		"unsorted": func(yield func([]byte, []byte) bool) {
+			_ = yield([]byte("a"), nil) && yield([]byte("c"), nil) && yield([]byte("b"), nil)
+		},
+	} {
+		if err := tree.BulkLoad(input, 1); !errors.Is(err, ErrUnsorted) {
+			t.Fatalf("%s input should fail, got: %v", name, err)
+		}
+		if tree.metaData.Root != root {
+			t.Fatalf("%s input should not change the tree", name)
+		}
+	}
+
+	if err := tree.BulkLoad(sortedInput(0, 10, 1, smallValue), 0); err == nil {
+		t.Fatal("should reject a fill factor of 0")
+	}
+}
+
+// checkFill fails if a node below the root is less than a third full or an
+// internal node has a single child
+func checkFill(t *testing.T, tree BTree, ptr uint64, root bool) {
+	t.Helper()
+	data, _ := tree.storage.Get(ptr)
+	node := BNode(data)
+	used, _ := node.usedBytes()
+	if !root && 3*int(used) < tree.storage.PageSize() {
+		t.Fatalf("page %d is underfull: %d bytes", ptr, used)
+	}
+	if node.Type() == BNODE_LEAF {
+		return
+	}
+	if node.Keys() < 2 {
+		t.Fatalf("page %d has a single child", ptr)
+	}
+	for i := range node.Keys() {
+		kid, _ := node.getPtr(i)
+		checkFill(t, tree, kid, false)
+	}
+}
+
+func TestBulkLoadRightEdge(t *testing.T) {
+	// 120 of these fit into a leaf and 170 leaves into a node
+	fixed := func(i int) []byte {
+		return []byte(fmt.Sprintf("v%09d", i))
+	}
+	for _, n := range []int{1, 2, 120, 121, 150, 240, 241, 20400, 20401, 20521} {
+		t.Run(fmt.Sprintf("keys=%d", n), func(t *testing.T) {
+			storage := &MockStorage{
+				testing: t,
+				storage: map[uint64][]byte{},
+			}
+			tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+			if err := tree.BulkLoad(sortedInput(0, n, 1, fixed), 1); err != nil {
+				t.Fatalf("bulk load failed: %v", err)
+			}
+			checkTree(t, tree)
+			checkFill(t, tree, tree.metaData.Root, true)
+		})
+	}
+}
+
+func TestBulkLoadKeepsSubtrees(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+	if err := tree.BulkLoad(sortedInput(0, 100000, 2, smallValue), 1); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+	height := checkTree(t, tree)
+	pages := len(storage.storage)
+
+	// a few keys in the middle only rewrite the nodes on their way
+	written := storage.last
+	if err := tree.BulkLoad(sortedInput(50001, 50011, 2, smallValue), 1); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+	checkTree(t, tree)
+	checkFill(t, tree, tree.metaData.Root, true)
+	if n := int(storage.last - written); n > 2*height {
+		t.Fatalf("should only write the path to the keys, wrote %d of %d pages", n, pages)
+	}
+
+	// batches appended at the end keep the tree filled
+	for batch := range 20 {
+		written := storage.last
+		if err := tree.BulkLoad(sortedInput(100000+batch*1000, 101000+batch*1000, 1, smallValue), 1); err != nil {
+			t.Fatalf("bulk load failed: %v", err)
+		}
+		checkTree(t, tree)
+		checkFill(t, tree, tree.metaData.Root, true)
+		if n := int(storage.last - written); 10*n > pages {
+			t.Fatalf("batch %d should not rewrite the tree, wrote %d of %d pages", batch, n, pages)
+		}
+	}
+
+	count := 0
+	for k, v := range tree.All() {
+		var i int
+		fmt.Sscanf(string(k), "key-%d", &i)
+		if !bytes.Equal(v, smallValue(i)) {
+			t.Fatalf("wrong value for key %d", i)
+		}
+		count++
+	}
+	if count != 50000+5+20000 {
+		t.Fatalf("got the count wrong should: %d, is: %d", 50000+5+20000, count)
+	}
+}
+
+// TestKVBulkLoad loads a file with a single commit
+func TestKVBulkLoad(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	commit := db.storage.Metadata.Commit
+	if err := db.BulkLoad(sortedInput(0, 100000, 1, smallValue), 0.9); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+	if db.storage.Metadata.Commit != commit+1 {
+		t.Fatalf("bulk load should be a single commit, has: %d", db.storage.Metadata.Commit-commit)
+	}
+
+	unsorted := func(yield func([]byte, []byte) bool) {
+		_ = yield([]byte("z"), nil) && yield([]byte("a"), nil)
+	}
+	if err := db.BulkLoad(unsorted, 1); !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("unsorted input should fail, got: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	count := 0
+	for range db.Scan(nil, nil) {
+		count++
+	}
+	if count != 100000 {
+		t.Fatalf("got the count wrong should: 100000, is: %d", count)
+	}
+	if _, ok, _ := db.Get([]byte("z")); ok {
+		t.Fatal("failed bulk load should not be applied")
+	}
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Check walks every page reachable from the root and reports what does not
+// fit together instead of stopping at the first problem. A node is only
+// decoded after its sizes and offsets were found to be inside the page, so a
+// garbage page is reported, not followed.
+
+// CheckReport is the result of Check, the counts cover the pages that could
+// be read
+type CheckReport struct {
+	Height   int // levels of the tree, the leaves included
+	Keys     int
+	Nodes    int // internal nodes and leaves
+	Overflow int // pages of values stored out of line
+
+	// only filled in by the check of a file
+	Pages    uint64   // pages of the file, the meta page included
+	FreeList int      // nodes of the free list
+	Free     int      // pages on the free list
+	Leaked   []uint64 // pages that are neither used nor free
+
+	Problems []CorruptionError
+}
+
+// Err returns nil if no problem was found
+func (r *CheckReport) Err() error {
+	switch len(r.Problems) {
+	case 0:
+		return nil
+	case 1:
+		return &r.Problems[0]
+	}
+	return fmt.Errorf("%d problems, first: %w", len(r.Problems), &r.Problems[0])
+}
+
+type checker struct {
+	storage Storage
+	report  *CheckReport
+	used    map[uint64]string // what a page was seen as
+}
+
+func newChecker(storage Storage) *checker {
+	return &checker{
+		storage: storage,
+		report:  &CheckReport{},
+		used:    map[uint64]string{},
+	}
+}
+
+func (c *checker) problem(ptr uint64, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, CorruptionError{Page: ptr, Reason: fmt.Sprintf(format, args...)})
+}
+
+// use marks a page as seen, a page reached a second time is not checked
+// again
+func (c *checker) use(ptr uint64, as string) bool {
+	if ptr == 0 {
+		c.problem(ptr, "%s points to the meta page", as)
+		return false
+	}
+	if before, ok := c.used[ptr]; ok {
+		c.problem(ptr, "reached as %s, already reached as %s", as, before)
+		return false
+	}
+	c.used[ptr] = as
+	return true
+}
+
+func (c *checker) get(ptr uint64) (BNode, bool) {
+	data, err := c.storage.Get(ptr)
+	if err != nil {
+		c.problem(ptr, "read failed: %v", err)
+		return nil, false
+	}
+	if len(data) != c.storage.PageSize() {
+		c.problem(ptr, "has %d bytes, want %d", len(data), c.storage.PageSize())
+		return nil, false
+	}
+	return BNode(data), true
+}
+
+// Check verifies the tree below the root
+func (tree *BTree) Check() *CheckReport {
+	c := newChecker(tree.storage)
+	c.tree(tree.metaData.Root)
+	return c.report
+}
+
+func (c *checker) tree(root uint64) {
+	if root == 0 {
+		return
+	}
+	height, _ := c.node(root, true, nil, nil)
+	c.report.Height = height
+}
+
+// node checks the subtree at ptr whose keys must be >= lo and < hi, nil
+// bounds are open. It returns the height and the first key of the subtree.
+func (c *checker) node(ptr uint64, root bool, lo, hi []byte) (int, []byte) {
+	if !c.use(ptr, "node") {
+		return 0, nil
+	}
+	node, ok := c.get(ptr)
+	if !ok {
+		return 0, nil
+	}
+	c.report.Nodes++
+	if !c.layout(ptr, node) {
+		return 0, nil
+	}
+
+	btype := node.Type()
+	if btype != BNODE_LEAF && btype != BNODE_NODE {
+		c.problem(ptr, "unexpected node type %d", btype)
+		return 0, nil
+	}
+	if node.prefixed() && btype != BNODE_LEAF {
+		c.problem(ptr, "internal node in the prefixed format")
+	}
+	if node.Keys() == 0 {
+		if !root || btype != BNODE_LEAF {
+			c.problem(ptr, "node without keys")
+		}
+		return 1, nil
+	}
+
+	var first, prev []byte
+	height := 0
+	for i := uint16(0); i < node.Keys(); i++ {
+		key, _ := node.getKey(i)
+		if i == 0 {
+			first = key
+		} else if bytes.Compare(prev, key) >= 0 {
+			c.problem(ptr, "key %d is not above key %d", i, i-1)
+		}
+		if lo != nil && bytes.Compare(key, lo) < 0 || hi != nil && bytes.Compare(key, hi) >= 0 {
+			c.problem(ptr, "key %d is outside the range of its parent", i)
+		}
+		prev = key
+
+		kid, _ := node.getPtr(i)
+		if btype == BNODE_LEAF {
+			c.report.Keys++
+			if kid != 0 {
+				c.overflow(node, i, kid)
+			}
+			continue
+		}
+
+		var next []byte
+		if i+1 < node.Keys() {
+			next, _ = node.getKey(i + 1)
+		} else {
+			next = hi
+		}
+		h, kidFirst := c.node(kid, false, key, next)
+		if h == 0 {
+			continue // reported already
+		}
+		if !bytes.Equal(kidFirst, key) {
+			c.problem(ptr, "separator %d is not the first key of page %d", i, kid)
+		}
+		if height != 0 && h != height {
+			c.problem(ptr, "children have heights %d and %d", height, h)
+		}
+		height = max(height, h)
+	}
+	return height + 1, first
+}
+
+// layout checks that the sizes and offsets of a node stay inside the node
+func (c *checker) layout(ptr uint64, node BNode) bool {
+	if len(node) < HEADER+2 {
+		c.problem(ptr, "node of %d bytes", len(node))
+		return false
+	}
+	// offsetsStart wraps around on a garbage header of a large node
+	start := HEADER + 8*int(node.Keys())
+	if node.prefixed() {
+		start = HEADER + 2 + int(node.prefixLen())
+		if start > len(node) {
+			c.problem(ptr, "prefix of %d bytes does not fit", node.prefixLen())
+			return false
+		}
+	}
+	end := start + 2*int(node.Keys())
+	if end > len(node) {
+		c.problem(ptr, "%d keys do not fit", node.Keys())
+		return false
+	}
+	for i := uint16(0); i < node.Keys(); i++ {
+		pos := end + int(node.getOffset(i))
+		if pos+HEADER > len(node) {
+			c.problem(ptr, "offset of key %d is past the end", i)
+			return false
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
+		if node.prefixed() {
+			if vlen&VAL_OVERFLOW != 0 {
+				vlen &^= VAL_OVERFLOW
+				if vlen != 16 {
+					c.problem(ptr, "overflow reference of key %d has %d bytes", i, vlen)
+					return false
+				}
+			}
+		}
+		next := end + int(node.getOffset(i+1))
+		if pos+HEADER+klen+vlen != next {
+			c.problem(ptr, "offset of key %d does not match the size of key %d", i+1, i)
+			return false
+		}
+		if next > min(len(node), nodeCap(len(node))) {
+			c.problem(ptr, "key %d is past the end", i)
+			return false
+		}
+	}
+	return true
+}
+
+// overflow checks the chain of the value at idx of a leaf
+func (c *checker) overflow(leaf BNode, idx uint16, ptr uint64) {
+	val, _ := leaf.getVal(idx)
+	if len(val) != 8 {
+		c.problem(ptr, "value of %d bytes refers to the chain", len(val))
+		return
+	}
+	size := binary.LittleEndian.Uint64(val)
+	first, total := ptr, uint64(0)
+	for ptr != 0 {
+		if !c.use(ptr, "overflow page") {
+			return
+		}
+		page, ok := c.get(ptr)
+		if !ok {
+			return
+		}
+		c.report.Overflow++
+		if page.Type() != BNODE_OVERFLOW {
+			c.problem(ptr, "unexpected overflow page type %d", page.Type())
+			return
+		}
+		if int(page.Keys()) > len(page)-OVERFLOW_HEADER {
+			c.problem(ptr, "overflow page holds %d bytes", page.Keys())
+			return
+		}
+		total += uint64(page.Keys())
+		ptr = page.overflowNext()
+	}
+	if total != size {
+		c.problem(first, "overflow chain has %d bytes, want %d", total, size)
+	}
+}
+
+// Check verifies the tree and the free list of the last commit and the
+// checksum of every page. Writes wait while it runs.
+func (kv *KV) Check() *CheckReport {
+	kv.storage.begin()
+	defer kv.storage.writer.Unlock()
+	return kv.storage.check()
+}
+
+func (db *MMapStorage) check() *CheckReport {
+	tree := db.committedTree()
+	meta := tree.metaData
+	c := newChecker(tree.storage)
+	c.report.Pages = meta.Flushed
+
+	c.checksums(db, meta)
+	c.tree(meta.Root)
+	c.freeList(meta)
+
+	for ptr := uint64(1); ptr < meta.Flushed; ptr++ {
+		if _, ok := c.used[ptr]; !ok {
+			c.report.Leaked = append(c.report.Leaked, ptr)
+		}
+	}
+	for ptr, as := range c.used {
+		if ptr >= meta.Flushed {
+			c.problem(ptr, "%s is past the end of the file", as)
+		}
+	}
+	return c.report
+}
+
+// checksums verifies every page in the file, also those that were verified
+// when they were read
+func (c *checker) checksums(db *MMapStorage, meta *Metadata) {
+	if meta.bodyHeader() == 0 {
+		return
+	}
+	for ptr := uint64(1); ptr < meta.Flushed; ptr++ {
+		c.checksum(db, ptr, meta)
+	}
+}
+
+func (c *checker) checksum(db *MMapStorage, ptr uint64, meta *Metadata) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	page, pending, err := db.filePage(ptr, meta)
+	if err != nil {
+		c.problem(ptr, "read failed: %v", err)
+		return
+	}
+	if pending {
+		return // still in the log
+	}
+	if meta.Flags&FORMAT_ENCRYPTED != 0 {
+		_, err = db.decodePage(ptr, page, meta)
+	} else {
+		err = checkPage(ptr, page)
+	}
+	var corrupt *CorruptionError
+	if errors.As(err, &corrupt) {
+		c.problem(ptr, "%s", corrupt.Reason)
+	} else if err != nil {
+		c.problem(ptr, "%v", err)
+	}
+}
+
+// freeList walks the list from the head to the tail
+func (c *checker) freeList(meta *Metadata) {
+	perNode := uint64((c.storage.PageSize() - FREE_LIST_HEADER) / 8)
+	ptr, seq := meta.HeadPage, meta.HeadSeq
+	if ptr == 0 || ptr >= meta.Flushed {
+		return // files written before page reuse get a list on the next commit
+	}
+	for {
+		if !c.use(ptr, "free list node") {
+			return
+		}
+		data, ok := c.get(ptr)
+		if !ok {
+			return
+		}
+		node := LNode(data)
+		c.report.FreeList++
+
+		end := perNode
+		if ptr == meta.TailPage {
+			end = meta.TailSeq
+		}
+		for ; seq < end; seq++ {
+			if c.use(node.getPtr(int(seq)), "free page") {
+				c.report.Free++
+			}
+		}
+		if ptr == meta.TailPage {
+			return
+		}
+		ptr, seq = node.getNext(), 0
+	}
+}
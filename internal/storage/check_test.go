@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKVCheck(t *testing.T) {
+	for _, opts := range []Options{{}, {WAL: true}, {PrefixLeaves: true}} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			db, err := NewKVWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			defer db.Close()
+
+			for i := range 2000 {
+				val := []byte(fmt.Sprintf("value%d", i))
+				if i%100 == 0 {
+					val = []byte(strings.Repeat("x", 10000))
+				}
+				if err := db.Insert([]byte(fmt.Sprintf("key-%06d", i)), val); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			for i := 0; i < 2000; i += 3 {
+				if err := db.Delete([]byte(fmt.Sprintf("key-%06d", i))); err != nil {
+					t.Fatalf("failed to delete: %v", err)
+				}
+			}
+
+			report := db.Check()
+			if err := report.Err(); err != nil {
+				t.Fatalf("should not find problems: %v", err)
+			}
+			if report.Keys != 1333 {
+				t.Fatalf("got the count wrong should: 1333, is: %d", report.Keys)
+			}
+			if report.Height < 2 || report.Overflow == 0 || report.Free == 0 {
+				t.Fatalf("should count all kinds of pages: %+v", report)
+			}
+			if len(report.Leaked) != 0 {
+				t.Fatalf("should not leak pages: %v", report.Leaked)
+			}
+			used := report.Nodes + report.Overflow + report.FreeList + report.Free
+			if uint64(used)+1 != report.Pages {
+				t.Fatalf("every page should be used or free: %d of %d", used, report.Pages)
+			}
+		})
+	}
+}
+
+func TestKVCheckFindsCorruption(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for i := range 500 {
+		if err := db.Insert([]byte(fmt.Sprintf("key-%06d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// a page of the tree on the free list
+	storage := db.storage
+	root := storage.Metadata.Root
+	if err := storage.free.PushTail(root); err != nil {
+		t.Fatalf("failed to push page: %v", err)
+	}
+	if err := storage.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	report := db.Check()
+	if len(report.Problems) != 1 || report.Problems[0].Page != root {
+		t.Fatalf("should report the root on the free list, got: %v", report.Problems)
+	}
+
+	// a page whose checksum no longer matches
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	stat, _ := f.Stat()
+	last := stat.Size()/BTREE_PAGE_SIZE - 1
+	if _, err := f.WriteAt([]byte{0xff}, last*BTREE_PAGE_SIZE+100); err != nil {
+		t.Fatalf("failed to corrupt page: %v", err)
+	}
+	f.Close()
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	report = db.Check()
+	found := false
+	for _, problem := range report.Problems {
+		found = found || problem.Page == uint64(last) && strings.Contains(problem.Reason, "checksum")
+	}
+	if !found {
+		t.Fatalf("should report the checksum of page %d, got: %v", last, report.Problems)
+	}
+}
+
+func TestCheckTree(t *testing.T) {
+	newTree := func() (BTree, *MockStorage) {
+		storage := &MockStorage{
+			testing: t,
+			storage: map[uint64][]byte{},
+		}
+		tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+		for i := range 1000 {
+			tree.Insert([]byte(fmt.Sprintf("key-%06d", i)), []byte("value"))
+		}
+		if err := tree.Check().Err(); err != nil {
+			t.Fatalf("should not find problems: %v", err)
+		}
+		return tree, storage
+	}
+	kid := func(tree BTree, storage *MockStorage, i uint16) (uint64, BNode) {
+		ptr, _ := BNode(storage.storage[tree.metaData.Root]).getPtr(i)
+		return ptr, BNode(storage.storage[ptr])
+	}
+
+	for name, corrupt := range map[string]func(BTree, *MockStorage) uint64{
+		"keys out of order": func(tree BTree, storage *MockStorage) uint64 {
+			ptr, leaf := kid(tree, storage, 1)
+			entries, _ := leaf.entries(0, leaf.Keys())
+			entries[1], entries[2] = entries[2], entries[1]
+			storage.storage[ptr] = buildNode(BNODE_LEAF, false, entries, BTREE_PAGE_SIZE)
+			return ptr
+		},
+		"wrong separator": func(tree BTree, storage *MockStorage) uint64 {
+			root := BNode(storage.storage[tree.metaData.Root])
+			entries, _ := root.entries(0, root.Keys())
+			entries[1].key = append(entries[1].key, 0)
+			storage.storage[tree.metaData.Root] = buildNode(BNODE_NODE, false, entries, BTREE_PAGE_SIZE)
+			return tree.metaData.Root
+		},
+		"page reached twice": func(tree BTree, storage *MockStorage) uint64 {
+			root := BNode(storage.storage[tree.metaData.Root])
+			ptr, _ := root.getPtr(1)
+			root.setPtr(2, ptr)
+			return ptr
+		},
+		"offset past the end": func(tree BTree, storage *MockStorage) uint64 {
+			ptr, leaf := kid(tree, storage, 0)
+			leaf.setOffset(leaf.Keys(), 0xffff)
+			return ptr
+		},
+		"unexpected type": func(tree BTree, storage *MockStorage) uint64 {
+			ptr, leaf := kid(tree, storage, 0)
+			leaf.setHeader(BNODE_OVERFLOW, leaf.Keys())
+			return ptr
+		},
+	} {
+		tree, storage := newTree()
+		ptr := corrupt(tree, storage)
+		report := tree.Check()
+		found := false
+		for _, problem := range report.Problems {
+			found = found || problem.Page == ptr
+		}
+		if !found {
+			t.Fatalf("%s should be reported on page %d, got: %v", name, ptr, report.Problems)
+		}
+	}
+}
+
+func TestCheckLayoutOfLargeNode(t *testing.T) {
+	// the offsets of 8192 keys would start past the end of a 64K node
+	node := BNode(make([]byte, BTREE_MAX_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, 8192)
+	c := newChecker(&MockStorage{testing: t, storage: map[uint64][]byte{}})
+	if c.layout(1, node) {
+		t.Fatal("should not accept the layout")
+	}
+	if len(c.report.Problems) != 1 || !strings.Contains(c.report.Problems[0].Reason, "keys do not fit") {
+		t.Fatalf("should report the keys, got: %v", c.report.Problems)
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Files created with FORMAT_PAGE_CHECKSUMS start every page but the meta page
+// with a header that belongs to the storage. Nodes only see the rest of the
+// page, so they are PAGE_HEADER bytes smaller than the pages of the file.
+
+// Page format
+// | checksum | node                       |
+// | 4B       | page size - PAGE_HEADER    |
+
+// The checksum is a CRC32C of the page number followed by the node, so a page
+// written to the wrong place is detected as well.
+
+// Files created with FORMAT_PAGE_VERSIONS put the commit that wrote a page in
+// front of its node as its version. Checksums, encryption and compression
+// treat the two as one body.
+
+// Versioned page format
+// | checksum | version | node                                    |
+// | 4B       | 8B      | page size - PAGE_HEADER - PAGE_VERSION  |
+
+const (
+	PAGE_HEADER  = 4
+	PAGE_VERSION = 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError reports a page whose content does not match its checksum
+type CorruptionError struct {
+	Page   uint64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("page %d is corrupted: %s", e.Page, e.Reason)
+}
+
+func pageChecksum(ptr uint64, node []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, binary.LittleEndian.AppendUint64(nil, ptr))
+	return crc32.Update(sum, castagnoli, node)
+}
+
+// pageHeader is the size of the header in front of every node, for
+// encrypted pages it includes the tag behind the node
+func (db *MMapStorage) pageHeader() int {
+	return db.Metadata.pageHeader()
+}
+
+func (data Metadata) pageHeader() int {
+	return data.bodyHeader() + data.versionSize()
+}
+
+// bodyHeader is the part of pageHeader around the body, the node with its
+// version in front
+func (data Metadata) bodyHeader() int {
+	header := 0
+	switch {
+	case data.Flags&FORMAT_ENCRYPTED != 0:
+		header = ENCRYPTED_OVERHEAD
+	case data.Flags&FORMAT_PAGE_CHECKSUMS != 0:
+		header = PAGE_HEADER
+	}
+	if data.Flags&FORMAT_COMPRESSED != 0 {
+		header += COMPRESSED_HEADER
+	}
+	return header
+}
+
+func (data Metadata) versionSize() int {
+	if data.Flags&FORMAT_PAGE_VERSIONS != 0 {
+		return PAGE_VERSION
+	}
+	return 0
+}
+
+// encodePage returns the bytes written to the file for node at ptr, gen is
+// the generation of an encrypted page. Compressed pages are returned without
+// their padding, see compress.go.
+func (db *MMapStorage) encodePage(ptr uint64, node []byte, meta *Metadata, gen uint64) []byte {
+	if meta.Flags&FORMAT_PAGE_VERSIONS != 0 {
+		body := make([]byte, PAGE_VERSION, PAGE_VERSION+len(node))
+		binary.LittleEndian.PutUint64(body, meta.Commit)
+		node = append(body, node...)
+	}
+	if meta.Flags&FORMAT_COMPRESSED != 0 {
+		return db.encodeCompressed(ptr, node, meta, gen)
+	}
+	if meta.Flags&FORMAT_ENCRYPTED != 0 {
+		return db.cipher.seal(ptr, gen, node)
+	}
+	if meta.bodyHeader() == 0 {
+		return node
+	}
+	page := make([]byte, meta.PageSize)
+	binary.LittleEndian.PutUint32(page[0:4], pageChecksum(ptr, node))
+	copy(page[PAGE_HEADER:], node)
+	return page
+}
+
+// decodePage returns the node of a page read from the file
+func (db *MMapStorage) decodePage(ptr uint64, page []byte, meta *Metadata) ([]byte, error) {
+	body, err := db.decodeBody(ptr, page, meta)
+	if err != nil {
+		return nil, err
+	}
+	return body[meta.versionSize():], nil
+}
+
+// decodeBody returns the node of a page with its version in front
+func (db *MMapStorage) decodeBody(ptr uint64, page []byte, meta *Metadata) ([]byte, error) {
+	if meta.Flags&FORMAT_COMPRESSED != 0 {
+		return db.decodeCompressed(ptr, page, meta)
+	}
+	if meta.Flags&FORMAT_ENCRYPTED != 0 {
+		return db.cipher.open(ptr, page)
+	}
+	if err := db.verifyPage(ptr, page, meta); err != nil {
+		return nil, err
+	}
+	return page[meta.bodyHeader():], nil
+}
+
+// verifyPage checks a page read from the file the first time it is used,
+// the page file tells which ones were, see pagefile.go. The caller holds mu.
+func (db *MMapStorage) verifyPage(ptr uint64, page []byte, meta *Metadata) error {
+	if meta.bodyHeader() == 0 {
+		return nil
+	}
+	offset := int64(ptr * meta.PageSize)
+	if db.pages.verified(offset, page) {
+		return nil
+	}
+	if err := checkPage(ptr, page); err != nil {
+		return err
+	}
+	db.pages.verify(offset, page)
+	return nil
+}
+
+// checkPage compares the checksum of a page with the one in its header
+func checkPage(ptr uint64, page []byte) error {
+	want := binary.LittleEndian.Uint32(page[0:4])
+	if got := pageChecksum(ptr, page[PAGE_HEADER:]); got != want {
+		return &CorruptionError{
+			Page:   ptr,
+			Reason: fmt.Sprintf("checksum %#08x, want %#08x", got, want),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Compact copies the keys of the last commit into a new file with full
+// nodes and no free pages, then renames it over the old file. A crash before
+// the rename leaves the old file as it was, the new one is only a leftover
+// next to it. A database in memory is copied into new memory.
+
+const COMPACT_SUFFIX = "-compact"
+
+// Compact shrinks the file to the pages the keys need. Writes wait for it,
+// snapshots and scans that are open go on reading the old file.
+func (kv *KV) Compact() error {
+	if kv.storage.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	kv.storage.begin()
+	defer kv.storage.writer.Unlock()
+	return kv.storage.compact(kv.storage.Options.Key)
+}
+
+// compact writes the copy encrypted with key, see Rekey
+func (db *MMapStorage) compact(key []byte) error {
+	tmpPath := ""
+	if !db.inMemory() {
+		tmpPath = db.Path + COMPACT_SUFFIX
+	}
+	dst, err := db.copyTo(tmpPath, key)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// the log belongs to the old file, it must be gone before the rename
+	if db.wal != nil {
+		if err := db.closeWAL(); err != nil {
+			dst.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err = db.swap(dst); err != nil && !db.inMemory() {
+		os.Remove(tmpPath)
+	}
+	if walErr := db.startWAL(); err == nil {
+		err = walErr
+	}
+	return err
+}
+
+// copyTo bulk loads the keys of the last commit into a new file at path and
+// returns it still open
+func (db *MMapStorage) copyTo(path string, key []byte) (*MMapStorage, error) {
+	if path != "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("remove old compaction: %w", err)
+		}
+	}
+	opts := db.Options
+	opts.WAL = false
+	opts.PrefixLeaves = db.Metadata.Flags&FORMAT_PREFIX_LEAVES != 0
+	opts.PageSize = int(db.Metadata.PageSize)
+	opts.Compression = CODEC_NONE
+	if db.Metadata.Flags&FORMAT_COMPRESSED != 0 {
+		opts.Compression = db.Metadata.Codec
+	}
+	opts.Key = key
+	dst := &MMapStorage{Path: path, Options: opts}
+	if err := dst.Open(); err != nil {
+		return nil, err
+	}
+	src := db.committedTree()
+	// the copy goes on with the versions of the file, so a backup of it
+	// taken since an older one has every page
+	dst.Metadata.Commit = max(dst.Metadata.Commit, src.metaData.Commit)
+	scanner := src.NewScanner(nil, nil)
+	err := dst.tree.BulkLoad(scanner.All(), 1)
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		dst.Close()
+		return nil, err
+	}
+	return dst, nil
+}
+
+// swap continues with the compacted storage dst. Its file is renamed over
+// the old one while it is still open and locked, so no other process gets in
+// between. Holding mu keeps readers out while the file is replaced.
+func (db *MMapStorage) swap(dst *MMapStorage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var err error
+	if !db.inMemory() {
+		if err := os.Rename(dst.Path, db.Path); err != nil {
+			dst.Close()
+			return fmt.Errorf("rename compacted file: %w", err)
+		}
+		// the new file is in place, only the rename might not be durable
+		err = syncDir(filepath.Dir(db.Path))
+	}
+	err = errors.Join(err, db.retire())
+
+	db.file, db.fd = dst.file, dst.fd
+	db.pages = dst.pages
+	db.Options.Key = dst.Options.Key
+	db.cipher, db.gen = dst.cipher, dst.gen
+	db.metaCommit = dst.metaCommit
+	db.Metadata = dst.Metadata
+	db.committed = *dst.Metadata
+	db.tree = BTree{metaData: db.Metadata, storage: db}
+	db.free = FreeList{storage: db, metadata: db.Metadata}
+	return err
+}
+
+// retire closes the replaced file, or keeps it open for the snapshots that
+// still read it. Their pins no longer limit the free list of the new file.
+func (db *MMapStorage) retire() error {
+	old := &MMapStorage{Path: db.Path, Options: db.Options, file: db.file, fd: db.fd, pages: db.pages, cipher: db.cipher}
+	retired := &retiredFile{storage: old}
+	for _, pin := range db.pins {
+		if pin.refs > 0 {
+			pin.retired = retired
+			retired.pins++
+		}
+	}
+	db.pins = nil
+	if retired.pins == 0 {
+		return old.Close()
+	}
+	db.retired = append(db.retired, retired)
+	return nil
+}
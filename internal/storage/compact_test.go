@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKVCompact(t *testing.T) {
+	for _, opts := range []Options{{}, {WAL: true}, {PrefixLeaves: true, PageSize: 8192}} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+
+			value := func(i int) []byte {
+				// only on keys that are deleted again
+				if i%100 == 5 {
+					return []byte(strings.Repeat("x", 10000))
+				}
+				return []byte(fmt.Sprintf("value%d", i))
+			}
+			batch := WriteBatch{}
+			for i := range 5000 {
+				batch.Put([]byte(fmt.Sprintf("key-%06d", i)), value(i))
+			}
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			batch = WriteBatch{}
+			for i := range 5000 {
+				if i%10 != 0 {
+					batch.Delete([]byte(fmt.Sprintf("key-%06d", i)))
+				}
+			}
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			flushed := db.storage.Metadata.Flushed
+
+			snap := db.Snapshot()
+			if err := db.Compact(); err != nil {
+				t.Fatalf("failed to compact: %v", err)
+			}
+			// the snapshot goes on reading the old file until it is closed
+			seen := 0
+			scanner := snap.NewScanner(nil, nil)
+			for k, v := range scanner.All() {
+				var i int
+				fmt.Sscanf(string(k), "key-%d", &i)
+				if !bytes.Equal(v, value(i)) {
+					t.Fatalf("snapshot should read %s from the old file", k)
+				}
+				seen++
+			}
+			if scanner.Err() != nil || seen != 500 {
+				t.Fatalf("snapshot should see 500 keys, saw: %d, err: %v", seen, scanner.Err())
+			}
+			if len(db.storage.retired) != 1 {
+				t.Fatalf("old file should stay open for the snapshot")
+			}
+			snap.Close()
+			if len(db.storage.retired) != 0 {
+				t.Fatalf("old file should be closed with the last snapshot")
+			}
+			if 4*db.storage.Metadata.Flushed > flushed {
+				t.Fatalf("compacted file should be much smaller: %d -> %d pages", flushed, db.storage.Metadata.Flushed)
+			}
+			if _, err := os.Stat(dbPath + COMPACT_SUFFIX); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("compaction should not leave a file behind: %v", err)
+			}
+
+			// the compacted file takes writes and survives a reopen
+			if err := db.Insert([]byte("key-000001"), []byte("new")); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close database: %v", err)
+			}
+			stat, err := os.Stat(dbPath)
+			if err != nil {
+				t.Fatalf("failed to stat file: %v", err)
+			}
+			meta := db.storage.Metadata
+			if stat.Size() != int64(meta.Flushed*meta.PageSize) {
+				t.Fatalf("file should only hold %d pages, has %d bytes", meta.Flushed, stat.Size())
+			}
+
+			db, err = NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			count := 0
+			for k, v := range db.Scan(nil, nil) {
+				var i int
+				fmt.Sscanf(string(k), "key-%d", &i)
+				want := value(i)
+				if i == 1 {
+					want = []byte("new")
+				}
+				if !bytes.Equal(v, want) {
+					t.Fatalf("wrong value for key %s", k)
+				}
+				count++
+			}
+			if count != 501 {
+				t.Fatalf("got the count wrong should: 501, is: %d", count)
+			}
+		})
+	}
+}
+
+// TestKVCompactWaitingOpener expects a process waiting for the lock to end
+// up with the compacted file, not the one renamed away
+func TestKVCompactWaitingOpener(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("key"), []byte("old")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	opened := make(chan *KV, 1)
+	go func() {
+		other, err := NewKVWithOptions(dbPath, Options{WaitForLock: true})
+		if err != nil {
+			t.Errorf("waiting opener failed: %v", err)
+		}
+		opened <- other
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	select {
+	case <-opened:
+		t.Fatal("opener should wait for the compacted file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.Insert([]byte("key"), []byte("new")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	other := <-opened
+	if other == nil {
+		return
+	}
+	defer other.Close()
+	if val, found, err := other.Get([]byte("key")); err != nil || !found || string(val) != "new" {
+		t.Fatalf("opener should read the compacted file, got: %q %v %v", val, found, err)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Files created with Options.Compression store every page but the meta page
+// compressed with the codec recorded in the meta page. A page keeps its place
+// in the file, the compressed node is followed by zeros that are given back
+// to the file system as a hole. On disk a page is an extent of as many blocks
+// as its compressed node needs, which pays off once pages are larger than
+// the blocks of the file system, e.g. 16K pages on 4K blocks.
+
+// Pages are not packed: a page is never smaller than a block, so with the
+// default 4K pages on 4K blocks compression saves no space, it only costs
+// the time to compress. A page also takes all of its blocks on file systems
+// without holes. Packing compressed pages into shared extents needs a map
+// from page to extent that is written with every commit, it is not done.
+
+// Compressed page format
+// | checksum | size | data | zeros |
+// | 4B       | 4B   | size |       |
+//
+// Encrypted, the size is authenticated with the data
+// | generation | size | data | tag | zeros |
+// | 8B         | 4B   | size | 16B |       |
+
+// data is the compressed body, or the body itself if it did not get smaller,
+// then size is the body size. The body is the node with its version in
+// front, see checksum.go.
+
+type Codec uint64
+
+const (
+	CODEC_NONE Codec = iota
+	CODEC_DEFLATE
+)
+
+const COMPRESSED_HEADER = 4
+
+var deflaters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+var inflaters = sync.Pool{New: func() any {
+	return flate.NewReader(nil)
+}}
+
+func checkCodec(codec Codec) error {
+	switch codec {
+	case CODEC_NONE, CODEC_DEFLATE:
+		return nil
+	}
+	return fmt.Errorf("unsupported codec: %d", codec)
+}
+
+// compressNode returns the data stored for node
+func compressNode(node []byte) []byte {
+	var buf bytes.Buffer
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+	w.Reset(&buf)
+	w.Write(node)
+	w.Close()
+	if buf.Len() >= len(node) {
+		return node
+	}
+	return buf.Bytes()
+}
+
+// decompressNode returns the node of size bytes stored as data
+func decompressNode(ptr uint64, data []byte, size int) ([]byte, error) {
+	if len(data) == size {
+		return data, nil
+	}
+	r := inflaters.Get().(io.ReadCloser)
+	defer inflaters.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	node := make([]byte, size)
+	if _, err := io.ReadFull(r, node); err != nil {
+		return nil, &CorruptionError{Page: ptr, Reason: fmt.Sprintf("decompress: %v", err)}
+	}
+	return node, nil
+}
+
+// encodeCompressed returns the bytes written to the file for node at ptr
+// without the padding, the slice has the capacity of the whole page
+func (db *MMapStorage) encodeCompressed(ptr uint64, node []byte, meta *Metadata, gen uint64) []byte {
+	data := compressNode(node)
+	page := make([]byte, meta.PageSize)
+	if meta.Flags&FORMAT_ENCRYPTED != 0 {
+		binary.LittleEndian.PutUint64(page[0:8], gen)
+		binary.LittleEndian.PutUint32(page[8:12], uint32(len(data)))
+		sealed := db.cipher.aead.Seal(page[12:12], nonce(ptr, gen), data, page[8:12])
+		return page[:12+len(sealed)]
+	}
+	binary.LittleEndian.PutUint32(page[4:8], uint32(len(data)))
+	copy(page[8:], data)
+	binary.LittleEndian.PutUint32(page[0:4], pageChecksum(ptr, page[PAGE_HEADER:]))
+	return page[:8+len(data)]
+}
+
+// decodeCompressed returns the node of a compressed page read from the file
+func (db *MMapStorage) decodeCompressed(ptr uint64, page []byte, meta *Metadata) ([]byte, error) {
+	size := int(meta.PageSize) - meta.bodyHeader()
+	if meta.Flags&FORMAT_ENCRYPTED != 0 {
+		n := int(binary.LittleEndian.Uint32(page[8:12]))
+		if n > size {
+			return nil, &CorruptionError{Page: ptr, Reason: fmt.Sprintf("bad size %d", n)}
+		}
+		gen := binary.LittleEndian.Uint64(page[0:8])
+		sealed := page[12:][:n+db.cipher.aead.Overhead()]
+		data, err := db.cipher.aead.Open(nil, nonce(ptr, gen), sealed, page[8:12])
+		if err != nil {
+			return nil, &CorruptionError{Page: ptr, Reason: "authentication failed"}
+		}
+		return decompressNode(ptr, data, size)
+	}
+
+	if err := db.verifyPage(ptr, page, meta); err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint32(page[4:8]))
+	if n > size {
+		return nil, &CorruptionError{Page: ptr, Reason: fmt.Sprintf("bad size %d", n)}
+	}
+	return decompressNode(ptr, page[8:][:n], size)
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func jsonValue(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id": %d, "name": "customer %d", "tags": ["a", "b", "c"], "active": true}`, i, i))
+}
+
+func TestKVCompressed(t *testing.T) {
+	for _, opts := range []Options{
+		{Compression: CODEC_DEFLATE},
+		{Compression: CODEC_DEFLATE, PageSize: 16384, PrefixLeaves: true},
+		{Compression: CODEC_DEFLATE, Key: testKey},
+		{Compression: CODEC_DEFLATE, WAL: true, Backend: BACKEND_PREAD},
+	} {
+		t.Run(fmt.Sprintf("PageSize=%d,Key=%v,WAL=%v", opts.PageSize, opts.Key != nil, opts.WAL), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			random := make([]byte, 3000)
+			rand.Read(random)
+			large := bytes.Repeat(jsonValue(0), 200)
+
+			batch := WriteBatch{}
+			for i := range 2000 {
+				batch.Put([]byte(fmt.Sprintf("key-%06d", i)), jsonValue(i))
+			}
+			batch.Put([]byte("large"), large)
+			batch.Put([]byte("random"), random)
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close database: %v", err)
+			}
+
+			// the codec is a property of the file
+			reopen := opts
+			reopen.Compression = CODEC_NONE
+			db, err = NewKVWithOptions(dbPath, reopen)
+			if err != nil {
+				t.Fatalf("failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			if db.storage.Metadata.Flags&FORMAT_COMPRESSED == 0 || db.storage.Metadata.Codec != CODEC_DEFLATE {
+				t.Fatalf("meta should record the codec, got: %+v", db.storage.Metadata)
+			}
+			for i := range 2000 {
+				val, found, err := db.Get([]byte(fmt.Sprintf("key-%06d", i)))
+				if err != nil || !found || !bytes.Equal(val, jsonValue(i)) {
+					t.Fatalf("key %d mismatch: %s, %v, %v", i, val, found, err)
+				}
+			}
+			if val, _, err := db.Get([]byte("large")); err != nil || !bytes.Equal(val, large) {
+				t.Fatalf("large value mismatch: %d bytes, %v", len(val), err)
+			}
+			if val, _, err := db.Get([]byte("random")); err != nil || !bytes.Equal(val, random) {
+				t.Fatalf("incompressible value mismatch: %d bytes, %v", len(val), err)
+			}
+			if err := db.Check().Err(); err != nil {
+				t.Fatalf("check should not find problems: %v", err)
+			}
+
+			if err := db.Compact(); err != nil {
+				t.Fatalf("failed to compact: %v", err)
+			}
+			if db.storage.Metadata.Codec != CODEC_DEFLATE {
+				t.Fatal("compacted file should stay compressed")
+			}
+			if val, _, err := db.Get([]byte("key-000042")); err != nil || !bytes.Equal(val, jsonValue(42)) {
+				t.Fatalf("key mismatch after compaction: %s, %v", val, err)
+			}
+		})
+	}
+}
+
+// allocated returns the bytes the file system allocated for a file
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	return stat.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestKVCompressedUsesLessSpace(t *testing.T) {
+	sizes := map[Codec]int64{}
+	for _, codec := range []Codec{CODEC_NONE, CODEC_DEFLATE} {
+		dbPath := filepath.Join(t.TempDir(), "test.db")
+		db, err := NewKVWithOptions(dbPath, Options{Compression: codec, PageSize: 65536})
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		batch := WriteBatch{}
+		for i := range 5000 {
+			batch.Put([]byte(fmt.Sprintf("key-%06d", i)), jsonValue(i))
+		}
+		if err := db.Write(&batch); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close database: %v", err)
+		}
+		sizes[codec] = allocated(t, dbPath)
+	}
+	if sizes[CODEC_DEFLATE] == sizes[CODEC_NONE] {
+		t.Skip("file system does not support holes")
+	}
+	if 2*sizes[CODEC_DEFLATE] > sizes[CODEC_NONE] {
+		t.Fatalf("compressed file should take much less space: %d, uncompressed: %d", sizes[CODEC_DEFLATE], sizes[CODEC_NONE])
+	}
+}
+
+func TestKVCompressedDetectsCorruptPage(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{Compression: CODEC_DEFLATE})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	root := db.storage.Metadata.Root
+	db.Close()
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(root*BTREE_PAGE_SIZE)+10); err != nil {
+		t.Fatalf("failed to corrupt page: %v", err)
+	}
+	f.Close()
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if _, _, err := db.Get([]byte("key1")); err == nil {
+		t.Fatal("should report the corrupt page")
+	}
+}
+
+func TestKVUnknownCodec(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	if _, err := NewKVWithOptions(dbPath, Options{Compression: 7}); err == nil {
+		t.Fatal("open with an unknown codec should fail")
+	}
+}
@@ -0,0 +1,248 @@
+package storage
+
+// Cursor walks the keys of a tree in both directions. It keeps the path from
+// the root to the current leaf, so stepping to a neighbour only reads the
+// nodes it has not seen yet. A cursor must not be used after the tree was
+// changed, the pages on its path may have been reused. The cursors of a KV
+// and of a Snapshot read a commit that is pinned until they are closed.
+//
+// All positioning methods return whether the cursor is at a key. Once they
+// return false Err tells an I/O error apart from the end of the tree.
+type Cursor struct {
+	tree  *BTree
+	snap  *Snapshot // taken by KV.NewCursor, released by Close
+	nodes []BNode   // from the root down to the current leaf
+	pos   []uint16  // index of the key in each node of the path
+	valid bool
+	err   error
+}
+
+func (tree *BTree) NewCursor() *Cursor {
+	return &Cursor{tree: tree}
+}
+
+// Close releases the snapshot of a cursor returned by KV.NewCursor, the
+// cursor is not valid afterwards
+func (c *Cursor) Close() {
+	c.valid = false
+	c.nodes, c.pos = nil, nil
+	if c.snap != nil {
+		c.snap.Close()
+	}
+}
+
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Key returns the current key, it is only valid until the cursor moves
+func (c *Cursor) Key() []byte {
+	if !c.valid {
+		return nil
+	}
+	leaf := len(c.nodes) - 1
+	key, err := c.nodes[leaf].getKey(c.pos[leaf])
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	return key
+}
+
+func (c *Cursor) Value() []byte {
+	if !c.valid {
+		return nil
+	}
+	leaf := len(c.nodes) - 1
+	val, err := c.nodes[leaf].leafValue(c.pos[leaf], c.tree.storage)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	return val
+}
+
+// First moves to the smallest key
+func (c *Cursor) First() bool {
+	if !c.reset(false) {
+		return false
+	}
+	return c.descend(false)
+}
+
+// Last moves to the largest key
+func (c *Cursor) Last() bool {
+	if !c.reset(true) {
+		return false
+	}
+	return c.descend(true)
+}
+
+// SeekGE moves to the smallest key greater than or equal to key
+func (c *Cursor) SeekGE(key []byte) bool {
+	ok, found := c.seek(key)
+	if !ok {
+		return false
+	}
+	leaf := len(c.nodes) - 1
+	if !found && c.pos[leaf] == c.nodes[leaf].Keys() {
+		// key is above all keys of this leaf
+		c.pos[leaf]--
+		return c.Next()
+	}
+	c.valid = true
+	return true
+}
+
+// SeekLE moves to the largest key less than or equal to key
+func (c *Cursor) SeekLE(key []byte) bool {
+	ok, found := c.seek(key)
+	if !ok {
+		return false
+	}
+	leaf := len(c.nodes) - 1
+	if !found {
+		if c.pos[leaf] == 0 {
+			// key is below all keys of this leaf
+			return c.Prev()
+		}
+		c.pos[leaf]--
+	}
+	c.valid = true
+	return true
+}
+
+// Next moves to the following key
+func (c *Cursor) Next() bool {
+	if !c.valid {
+		return false
+	}
+	// Go up until a node has a key to the right
+	level := len(c.nodes) - 1
+	for level >= 0 && c.pos[level]+1 >= c.nodes[level].Keys() {
+		level--
+	}
+	if level < 0 {
+		c.valid = false
+		return false
+	}
+	c.pos[level]++
+	c.nodes, c.pos = c.nodes[:level+1], c.pos[:level+1]
+	return c.descend(false)
+}
+
+// Prev moves to the preceding key
+func (c *Cursor) Prev() bool {
+	if !c.valid {
+		return false
+	}
+	// Go up until a node has a key to the left
+	level := len(c.nodes) - 1
+	for level >= 0 && c.pos[level] == 0 {
+		level--
+	}
+	if level < 0 {
+		c.valid = false
+		return false
+	}
+	c.pos[level]--
+	c.nodes, c.pos = c.nodes[:level+1], c.pos[:level+1]
+	return c.descend(true)
+}
+
+// reset starts a new path at the first or the last key of the root
+func (c *Cursor) reset(last bool) bool {
+	c.nodes, c.pos = c.nodes[:0], c.pos[:0]
+	c.valid = false
+	c.err = nil
+	data, err := c.tree.storage.Get(c.tree.metaData.Root)
+	if err != nil {
+		return c.fail(err)
+	}
+	root := BNode(data)
+	pos := uint16(0)
+	if last && root.Keys() > 0 {
+		pos = root.Keys() - 1
+	}
+	c.nodes = append(c.nodes, root)
+	c.pos = append(c.pos, pos)
+	return true
+}
+
+// seek descends to the leaf that can contain key and positions the cursor
+// where the key is or would be inserted
+func (c *Cursor) seek(key []byte) (ok bool, found bool) {
+	if !c.reset(false) {
+		return false, false
+	}
+	for {
+		level := len(c.nodes) - 1
+		node := c.nodes[level]
+		if node.Type() == BNODE_LEAF {
+			if node.Keys() == 0 {
+				return false, false // empty tree
+			}
+			idx, found, err := node.Lookup(key)
+			if err != nil {
+				return c.fail(err), false
+			}
+			c.pos[level] = idx
+			c.valid = true
+			return true, found
+		}
+		idx, err := node.LookupLE(key)
+		if err != nil {
+			return c.fail(err), false
+		}
+		c.pos[level] = idx
+		if !c.push(node, idx, false) {
+			return false, false
+		}
+	}
+}
+
+// descend follows the current position of the last node on the path down to
+// a leaf, entering each child at its first or its last key
+func (c *Cursor) descend(last bool) bool {
+	for {
+		level := len(c.nodes) - 1
+		node := c.nodes[level]
+		if node.Type() == BNODE_LEAF {
+			c.valid = node.Keys() > 0
+			return c.valid
+		}
+		if !c.push(node, c.pos[level], last) {
+			return false
+		}
+	}
+}
+
+// push adds the child at idx to the path
+func (c *Cursor) push(node BNode, idx uint16, last bool) bool {
+	ptr, err := node.getPtr(idx)
+	if err != nil {
+		return c.fail(err)
+	}
+	data, err := c.tree.storage.Get(ptr)
+	if err != nil {
+		return c.fail(err)
+	}
+	child := BNode(data)
+	pos := uint16(0)
+	if last && child.Keys() > 0 {
+		pos = child.Keys() - 1
+	}
+	c.nodes = append(c.nodes, child)
+	c.pos = append(c.pos, pos)
+	return true
+}
+
+func (c *Cursor) fail(err error) bool {
+	c.err = err
+	c.valid = false
+	return false
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// countingStorage counts the pages read through it
+type countingStorage struct {
+	Storage
+	gets int
+}
+
+func (s *countingStorage) Get(ptr uint64) ([]byte, error) {
+	s.gets++
+	return s.Storage.Get(ptr)
+}
+
+func cursorTree(t *testing.T) (BTree, *countingStorage, func(int) []byte) {
+	storage := &countingStorage{Storage: &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+
+	// every other key, so seeks can fall between keys; long keys for a few levels
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%04d-%s", i, strings.Repeat("k", 90)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		tree.Insert(key(i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if checkTree(t, tree) < 3 {
+		t.Fatal("tree should have at least 3 levels")
+	}
+	return tree, storage, key
+}
+
+func assertCursorAt(t *testing.T, c *Cursor, key []byte, i int) {
+	t.Helper()
+	if !c.Valid() {
+		t.Fatalf("cursor should be at key %d, err: %v", i, c.Err())
+	}
+	if !bytes.Equal(c.Key(), key) {
+		t.Fatalf("cursor should be at key %d, is at: %s", i, c.Key()[:8])
+	}
+	if string(c.Value()) != fmt.Sprintf("value%d", i) {
+		t.Fatalf("wrong value at key %d: %s", i, c.Value())
+	}
+}
+
+func TestCursorWalk(t *testing.T) {
+	tree, storage, key := cursorTree(t)
+	c := tree.NewCursor()
+
+	storage.gets = 0
+	i := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		assertCursorAt(t, c, key(i), i)
+		i += 2
+	}
+	if c.Err() != nil || i != 2000 {
+		t.Fatalf("should walk all keys, stopped at %d: %v", i, c.Err())
+	}
+	nodes := storage.gets
+
+	i = 1998
+	for ok := c.Last(); ok; ok = c.Prev() {
+		assertCursorAt(t, c, key(i), i)
+		i -= 2
+	}
+	if c.Err() != nil || i != -2 {
+		t.Fatalf("should walk all keys backwards, stopped at %d: %v", i, c.Err())
+	}
+
+	// every node is entered once, instead of a descent for every key
+	if nodes > 1000/5 {
+		t.Fatalf("walking 1000 keys read %d pages", nodes)
+	}
+	if c.Next() || c.Prev() {
+		t.Fatal("cursor past the end should stay there")
+	}
+}
+
+func TestCursorSeek(t *testing.T) {
+	tree, _, key := cursorTree(t)
+	c := tree.NewCursor()
+
+	for i := -1; i <= 2000; i++ {
+		k, ge, le := key(i), i+i%2, min(i-i%2, 1998) // the next and the previous even key
+		if i < 0 {
+			k, ge, le = []byte("a"), 0, -2
+		}
+
+		if c.SeekGE(k) != (ge < 2000) {
+			t.Fatalf("SeekGE(%d) valid: %v", i, c.Valid())
+		}
+		if ge < 2000 {
+			assertCursorAt(t, c, key(ge), ge)
+		}
+
+		if c.SeekLE(k) != (le >= 0) {
+			t.Fatalf("SeekLE(%d) valid: %v", i, c.Valid())
+		}
+		if le >= 0 {
+			assertCursorAt(t, c, key(le), le)
+		}
+	}
+
+	// change direction after a seek
+	c.SeekGE(key(1001))
+	c.Prev()
+	assertCursorAt(t, c, key(1000), 1000)
+	c.Next()
+	c.Next()
+	assertCursorAt(t, c, key(1004), 1004)
+}
+
+func TestCursorEmptyTree(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{},
+	}
+	tree, _ := NewBTree(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+	c := tree.NewCursor()
+
+	if c.First() || c.Last() || c.SeekGE([]byte("a")) || c.SeekLE([]byte("a")) {
+		t.Fatal("cursor on an empty tree should not be valid")
+	}
+	if c.Key() != nil || c.Value() != nil || c.Err() != nil {
+		t.Fatal("invalid cursor should have no key, value or error")
+	}
+}
+
+// failingStorage fails to read one page
+type failingStorage struct {
+	Storage
+	fail uint64
+}
+
+func (s *failingStorage) Get(ptr uint64) ([]byte, error) {
+	if ptr == s.fail {
+		return nil, &CorruptionError{Page: ptr, Reason: "test"}
+	}
+	return s.Storage.Get(ptr)
+}
+
+func TestCursorError(t *testing.T) {
+	tree, storage, _ := cursorTree(t)
+
+	// fail the second leaf
+	root, _ := storage.Get(tree.metaData.Root)
+	ptr, _ := BNode(root).getPtr(0)
+	inner, _ := storage.Get(ptr)
+	leaf, _ := BNode(inner).getPtr(1)
+	tree.storage = &failingStorage{Storage: storage, fail: leaf}
+
+	c := tree.NewCursor()
+	count := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		count++
+	}
+	if c.Err() == nil {
+		t.Fatal("should report the error")
+	}
+	if count == 0 || count >= 1000 {
+		t.Fatalf("should stop at the failing leaf, walked %d keys", count)
+	}
+	if c.First(); c.Err() != nil {
+		t.Fatalf("repositioning should clear the error: %v", c.Err())
+	}
+}
+
+func TestScanError(t *testing.T) {
+	tree, storage, _ := cursorTree(t)
+
+	// fail the second leaf
+	root, _ := storage.Get(tree.metaData.Root)
+	ptr, _ := BNode(root).getPtr(0)
+	inner, _ := storage.Get(ptr)
+	leaf, _ := BNode(inner).getPtr(1)
+	tree.storage = &failingStorage{Storage: storage, fail: leaf}
+
+	for name, scanner := range map[string]*Scanner{
+		"forward": tree.NewScanner(nil, nil),
+		"reverse": tree.NewReverseScanner(Bound{}, Bound{}),
+	} {
+		count := 0
+		for range scanner.All() {
+			count++
+		}
+		var corrupt *CorruptionError
+		if !errors.As(scanner.Err(), &corrupt) || corrupt.Page != leaf {
+			t.Fatalf("%s scan should report page %d, got: %v", name, leaf, scanner.Err())
+		}
+		if count == 0 || count >= 1000 {
+			t.Fatalf("%s scan should stop at the failing leaf, got %d keys", name, count)
+		}
+	}
+
+	// a scan that does not reach the leaf is fine
+	scanner := tree.NewScanner(nil, nil)
+	for range scanner.All() {
+		break
+	}
+	if scanner.Err() != nil {
+		t.Fatalf("should not report an error: %v", scanner.Err())
+	}
+}
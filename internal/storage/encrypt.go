@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Files created with Options.Key encrypt every page but the meta page with
+// AES-GCM. The key of the pages is derived from Options.Key and a random salt
+// of the file, so two files never share it. The meta page stays readable, it
+// only holds pointers, the salt and a key check derived the same way, which
+// lets Open tell a wrong key apart from a corrupted page.
+
+// Encrypted page format
+// | generation | node                            | tag |
+// | 8B         | page size - ENCRYPTED_OVERHEAD  | 16B |
+
+// The nonce is the page number followed by the generation of the write.
+// Every batch of page writes, a flush, a commit to the log or a checkpoint,
+// takes the next generation, so a nonce is never used twice within a file.
+// A process writes with the GENERATION_RESERVE generations that follow the
+// commit of a meta it wrote before any page, commits only grow, so one that
+// crashed in the middle of a commit cannot have used the ones of the next.
+
+const (
+	ENCRYPTED_OVERHEAD = 8 + 16
+	NONCE_SIZE         = 16
+	GENERATION_RESERVE = 1 << 32
+)
+
+var ErrWrongKey = errors.New("wrong encryption key")
+
+type pageCipher struct {
+	aead  cipher.AEAD
+	check [16]byte
+}
+
+func checkKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("key has %d bytes, want 16, 24 or 32", len(key))
+}
+
+// newPageCipher derives the page key of a file from key, an AES key of 16,
+// 24 or 32 bytes, and the salt of the file
+func newPageCipher(key []byte, salt [16]byte) (*pageCipher, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	pageKey, err := hkdf.Key(sha256.New, key, salt[:], "page key", len(key))
+	if err != nil {
+		return nil, err
+	}
+	check, err := hkdf.Key(sha256.New, key, salt[:], "key check", 16)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pageKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, NONCE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	c := &pageCipher{aead: aead}
+	copy(c.check[:], check)
+	return c, nil
+}
+
+func nonce(ptr, gen uint64) []byte {
+	n := binary.LittleEndian.AppendUint64(make([]byte, 0, NONCE_SIZE), ptr)
+	return binary.LittleEndian.AppendUint64(n, gen)
+}
+
+// seal returns the encrypted page of node at ptr
+func (c *pageCipher) seal(ptr, gen uint64, node []byte) []byte {
+	page := make([]byte, 8, ENCRYPTED_OVERHEAD+len(node))
+	binary.LittleEndian.PutUint64(page[0:8], gen)
+	return c.aead.Seal(page, nonce(ptr, gen), node, nil)
+}
+
+// open decrypts a page at ptr, pages that were changed or written to another
+// place fail
+func (c *pageCipher) open(ptr uint64, page []byte) ([]byte, error) {
+	gen := binary.LittleEndian.Uint64(page[0:8])
+	node, err := c.aead.Open(nil, nonce(ptr, gen), page[8:], nil)
+	if err != nil {
+		return nil, &CorruptionError{Page: ptr, Reason: "authentication failed"}
+	}
+	return node, nil
+}
+
+// openCipher checks Options.Key against the meta page of an existing file
+func (db *MMapStorage) openCipher() error {
+	encrypted := db.Metadata.Flags&FORMAT_ENCRYPTED != 0
+	if !encrypted {
+		if db.Options.Key != nil {
+			return errors.New("file is not encrypted, open it without a key")
+		}
+		return nil
+	}
+	if db.Options.Key == nil {
+		return fmt.Errorf("file is encrypted and no key was given: %w", ErrWrongKey)
+	}
+	c, err := newPageCipher(db.Options.Key, db.Metadata.Salt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(c.check[:], db.Metadata.KeyCheck[:]) != 1 {
+		return ErrWrongKey
+	}
+	db.cipher = c
+	return nil
+}
+
+// newCipher sets up the encryption of a new file
+func (db *MMapStorage) newCipher() error {
+	if db.Options.Key == nil {
+		return nil
+	}
+	if _, err := rand.Read(db.Metadata.Salt[:]); err != nil {
+		return fmt.Errorf("salt: %w", err)
+	}
+	c, err := newPageCipher(db.Options.Key, db.Metadata.Salt)
+	if err != nil {
+		return err
+	}
+	db.Metadata.Flags |= FORMAT_ENCRYPTED
+	db.Metadata.KeyCheck = c.check
+	db.cipher = c
+	return nil
+}
+
+// reserveGenerations starts the generations after commit, the commit of a
+// meta that is written before the first page
+func (db *MMapStorage) reserveGenerations(commit uint64) {
+	db.gen = commit * GENERATION_RESERVE
+}
+
+// nextGeneration returns the generation of the next batch of page writes
+func (db *MMapStorage) nextGeneration() (uint64, error) {
+	if db.cipher == nil {
+		return 0, nil
+	}
+	if db.gen%GENERATION_RESERVE == GENERATION_RESERVE-1 {
+		return 0, errors.New("page generations used up, reopen the file")
+	}
+	db.gen++
+	return db.gen, nil
+}
+
+// Rekey encrypts the database with key, nil stores it unencrypted. Like
+// Compact it writes a copy and renames it over the file, a crash before the
+// rename leaves the file with the old key.
+func (kv *KV) Rekey(key []byte) error {
+	if kv.storage.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	kv.storage.begin()
+	defer kv.storage.writer.Unlock()
+	if key != nil {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+	return kv.storage.compact(key)
+}
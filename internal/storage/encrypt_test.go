@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testKey  = bytes.Repeat([]byte{0x42}, 32)
+	otherKey = bytes.Repeat([]byte{0x17}, 16)
+)
+
+func TestKVEncrypted(t *testing.T) {
+	for _, opts := range []Options{{Key: testKey}, {Key: testKey, WAL: true}, {Key: testKey, Backend: BACKEND_PREAD}} {
+		t.Run(fmt.Sprintf("WAL=%v,Backend=%v", opts.WAL, opts.Backend), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			batch := WriteBatch{}
+			for i := range 500 {
+				batch.Put([]byte(fmt.Sprintf("secret-key-%03d", i)), []byte(fmt.Sprintf("secret-value-%d", i)))
+			}
+			batch.Put([]byte("large"), bytes.Repeat([]byte("secret-large"), 1000))
+			if err := db.Write(&batch); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if err := db.Delete([]byte("secret-key-007")); err != nil {
+				t.Fatalf("failed to delete: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close database: %v", err)
+			}
+
+			data, err := os.ReadFile(dbPath)
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			if bytes.Contains(data, []byte("secret")) {
+				t.Fatal("file should not contain plain keys or values")
+			}
+
+			if _, err := NewKVWithOptions(dbPath, Options{}); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("open without key should fail with ErrWrongKey, got: %v", err)
+			}
+			if _, err := NewKVWithOptions(dbPath, Options{Key: otherKey}); !errors.Is(err, ErrWrongKey) {
+				t.Fatalf("open with another key should fail with ErrWrongKey, got: %v", err)
+			}
+
+			db, err = NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			for i := range 500 {
+				val, found, err := db.Get([]byte(fmt.Sprintf("secret-key-%03d", i)))
+				if err != nil {
+					t.Fatalf("failed to get: %v", err)
+				}
+				if found != (i != 7) {
+					t.Fatalf("key %d exists: %v", i, found)
+				}
+				if found && string(val) != fmt.Sprintf("secret-value-%d", i) {
+					t.Fatalf("key %d mismatch: got %s", i, val)
+				}
+			}
+			val, _, err := db.Get([]byte("large"))
+			if err != nil || !bytes.Equal(val, bytes.Repeat([]byte("secret-large"), 1000)) {
+				t.Fatalf("large value mismatch: %d bytes, %v", len(val), err)
+			}
+			if err := db.Check().Err(); err != nil {
+				t.Fatalf("check should not find problems: %v", err)
+			}
+		})
+	}
+}
+
+func TestKVEncryptedOpenErrors(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	if _, err := NewKVWithOptions(dbPath, Options{Key: []byte("short")}); err == nil {
+		t.Fatal("open with a key that is not an AES key should fail")
+	}
+	os.Remove(dbPath)
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.Close()
+	if _, err := NewKVWithOptions(dbPath, Options{Key: testKey}); err == nil {
+		t.Fatal("open of a plain file with a key should fail")
+	}
+}
+
+func TestKVEncryptedDetectsTampering(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	root := db.storage.Metadata.Root
+	db.Close()
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	buf := make([]byte, 1)
+	offset := int64(root*BTREE_PAGE_SIZE) + 100
+	f.ReadAt(buf, offset)
+	buf[0] ^= 0x01
+	if _, err := f.WriteAt(buf, offset); err != nil {
+		t.Fatalf("failed to change page: %v", err)
+	}
+	f.Close()
+
+	db, err = NewKVWithOptions(dbPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	_, _, err = db.Get([]byte("key1"))
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) || corrupt.Page != root {
+		t.Fatalf("should report page %d as corrupted, got: %v", root, err)
+	}
+	if len(db.Check().Problems) == 0 {
+		t.Fatal("check should report the page")
+	}
+}
+
+func TestKVEncryptedGenerations(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	// the same node written twice to the same page is encrypted differently
+	if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	root := db.storage.Metadata.Root
+	first := make([]byte, BTREE_PAGE_SIZE)
+	db.storage.file.ReadAt(first, int64(root*BTREE_PAGE_SIZE))
+	for range 10 {
+		if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if db.storage.Metadata.Root == root {
+			break
+		}
+	}
+	if db.storage.Metadata.Root != root {
+		t.Fatalf("root page should be reused")
+	}
+	again := make([]byte, BTREE_PAGE_SIZE)
+	db.storage.file.ReadAt(again, int64(root*BTREE_PAGE_SIZE))
+	if bytes.Equal(first, again) {
+		t.Fatal("rewritten page should have a new generation")
+	}
+	used := db.storage.gen
+	db.Close()
+
+	// every open for writing reserves new generations
+	db, err = NewKVWithOptions(dbPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if db.storage.gen != db.storage.metaCommit*GENERATION_RESERVE {
+		t.Fatalf("generations should start at the commit of the open, got: %d", db.storage.gen)
+	}
+	if db.storage.gen/GENERATION_RESERVE <= used/GENERATION_RESERVE {
+		t.Fatalf("open should not reuse generations, got: %d, used: %d", db.storage.gen, used)
+	}
+}
+
+func TestKVEncryptedWALRecovers(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{Key: testKey, WAL: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := range 50 {
+		if err := db.Insert([]byte(fmt.Sprintf("secret%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	crashPath := filepath.Join(tempDir, "crash.db")
+	copyFile(t, dbPath, crashPath)
+	copyFile(t, dbPath+WAL_SUFFIX, crashPath+WAL_SUFFIX)
+	log, err := os.ReadFile(crashPath + WAL_SUFFIX)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	if len(log) == 0 || bytes.Contains(log, []byte("secret")) {
+		t.Fatalf("log should hold the commits encrypted, %d bytes", len(log))
+	}
+
+	if _, err := NewKVWithOptions(crashPath, Options{Key: otherKey}); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("recovery with another key should fail with ErrWrongKey, got: %v", err)
+	}
+	crashed, err := NewKVWithOptions(crashPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to recover database: %v", err)
+	}
+	defer crashed.Close()
+	for i := range 50 {
+		if _, found, err := crashed.Get([]byte(fmt.Sprintf("secret%03d", i))); err != nil || !found {
+			t.Fatalf("key %d should be recovered: %v, %v", i, found, err)
+		}
+	}
+}
+
+func TestKVRekey(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for i := range 100 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("secret")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	keys := [][]byte{testKey, otherKey, nil}
+	for _, key := range keys {
+		snap := db.Snapshot()
+		if err := db.Rekey(key); err != nil {
+			t.Fatalf("failed to rekey: %v", err)
+		}
+		// the snapshot reads the old file with the old key
+		if val, found, err := snap.Get([]byte("key042")); err != nil || !found || string(val) != "secret" {
+			t.Fatalf("snapshot should read the old file: %q %v %v", val, found, err)
+		}
+		snap.Close()
+		// the database keeps working with the new key
+		if err := db.Insert([]byte("after"), []byte("secret")); err != nil {
+			t.Fatalf("failed to insert after rekey: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close database: %v", err)
+		}
+
+		data, err := os.ReadFile(dbPath)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if bytes.Contains(data, []byte("secret")) != (key == nil) {
+			t.Fatalf("file with key %x should be encrypted: %v", key, key != nil)
+		}
+
+		if db, err = NewKVWithOptions(dbPath, Options{Key: key}); err != nil {
+			t.Fatalf("failed to open with the new key: %v", err)
+		}
+		for i := range 100 {
+			if _, found, err := db.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil || !found {
+				t.Fatalf("key %d should survive the rekey: %v, %v", i, found, err)
+			}
+		}
+	}
+	defer db.Close()
+
+	if err := db.Rekey([]byte("short")); err == nil {
+		t.Fatal("rekey with a key that is not an AES key should fail")
+	}
+}
+
+func TestMemKVRekey(t *testing.T) {
+	db, err := NewMemKV()
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := db.Rekey(testKey); err != nil {
+		t.Fatalf("failed to rekey: %v", err)
+	}
+	if db.storage.Metadata.Flags&FORMAT_ENCRYPTED == 0 {
+		t.Fatal("database should be encrypted")
+	}
+	if val, _, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Fatalf("key should survive the rekey: %s, %v", val, err)
+	}
+}
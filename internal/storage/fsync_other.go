@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// fdatasync falls back to fsync where there is no fdatasync
+func fdatasync(fd int) error {
+	return unix.Fsync(fd)
+}
@@ -1,18 +1,18 @@
 package storage
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"iter"
 	"os"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
 
 const (
 	DB_SIG          = "BuildYourOwnDB"
-	META_SIZE       = 32
+	META_SIZE       = 132
 	INITIAL_MMAP_MB = 1 // 1MB initial chunk
 )
 
@@ -20,8 +20,56 @@ type KV struct {
 	storage *MMapStorage
 }
 
+// Options configure new database files. Existing files keep the format they
+// were created with.
+type Options struct {
+	// PrefixLeaves stores the key prefix shared by a leaf only once
+	PrefixLeaves bool
+	// PageSize is a power of two between 4K and 64K, BTREE_PAGE_SIZE if 0.
+	// Opening an existing file with a different size fails.
+	PageSize int
+
+	// WAL commits to a log with a single fsync instead of writing the pages
+	// and the meta page, see wal.go
+	WAL bool
+	// CheckpointSize is the log size that starts a checkpoint in WAL mode,
+	// DEFAULT_CHECKPOINT_SIZE if 0
+	CheckpointSize int64
+
+	// ReadOnly opens an existing file without writing to it, writes fail
+	// with ErrReadOnly. Other read-only openers can share the file.
+	ReadOnly bool
+	// WaitForLock makes Open wait for a process holding the file instead of
+	// failing with ErrLocked
+	WaitForLock bool
+
+	// Compression stores the pages of a new file compressed with a codec,
+	// it only saves space with pages larger than the file system blocks,
+	// see compress.go
+	Compression Codec
+
+	// Key encrypts the pages of a new file with AES-GCM, it is an AES key
+	// of 16, 24 or 32 bytes. Encrypted files need it to be opened, see
+	// encrypt.go.
+	Key []byte
+
+	// Backend selects how pages are read from the file, see pagefile.go
+	Backend Backend
+	// CacheSize is the size of the page cache of BACKEND_PREAD in bytes,
+	// DEFAULT_CACHE_SIZE if 0
+	CacheSize int
+
+	// InMemory keeps the pages in memory instead of a file, the path must
+	// be empty then. See memory.go.
+	InMemory bool
+}
+
 func NewKV(filename string) (*KV, error) {
-	storage := &MMapStorage{Path: filename}
+	return NewKVWithOptions(filename, Options{})
+}
+
+func NewKVWithOptions(filename string, opts Options) (*KV, error) {
+	storage := &MMapStorage{Path: filename, Options: opts}
 	err := storage.Open()
 	if err != nil {
 		return nil, err
@@ -32,64 +80,222 @@ func NewKV(filename string) (*KV, error) {
 }
 
 func (kv *KV) Close() error {
+	kv.storage.writer.Lock()
+	defer kv.storage.writer.Unlock()
 	return kv.storage.Close()
 }
 
 func (kv *KV) Insert(key []byte, val []byte) error {
-	err := kv.storage.tree.Insert(key, val)
-	if err != nil {
-		return nil
-	}
-	return kv.storage.Sync()
+	batch := WriteBatch{}
+	batch.Put(key, val)
+	return kv.Write(&batch)
 }
 
+// Get reads the last commit, it does not wait for a write in progress. It
+// holds mu instead of a snapshot, the next commit and with it the reuse of
+// the pages it reads is only published once it is done.
 func (kv *KV) Get(key []byte) ([]byte, bool, error) {
-	return kv.storage.tree.Get(key)
+	db := kv.storage
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	meta := db.committed
+	tree := BTree{metaData: &meta, storage: readView{db: db, meta: &meta, locked: true}}
+	return tree.Get(key)
 }
 
+// Scan iterates the keys from start up to but not including end. The keys
+// are those of the last commit when the loop starts. A read error ends it
+// early, use NewScanner to see it.
 func (kv *KV) Scan(start, end []byte) iter.Seq2[[]byte, []byte] {
-	return kv.storage.tree.Scan(start, end)
+	return kv.NewScanner(start, end).All()
+}
+
+// ScanReverse iterates the keys between lo and hi in descending order
+func (kv *KV) ScanReverse(lo, hi Bound) iter.Seq2[[]byte, []byte] {
+	return kv.NewReverseScanner(lo, hi).All()
+}
+
+// NewScanner returns the scan of the keys from start up to but not
+// including end, check its Err once the loop is done
+func (kv *KV) NewScanner(start, end []byte) *Scanner {
+	return kv.pinned(func(snap *Snapshot) *Scanner {
+		return snap.NewScanner(start, end)
+	})
+}
+
+// NewReverseScanner returns the scan of the keys between lo and hi in
+// descending order
+func (kv *KV) NewReverseScanner(lo, hi Bound) *Scanner {
+	return kv.pinned(func(snap *Snapshot) *Scanner {
+		return snap.NewReverseScanner(lo, hi)
+	})
+}
+
+// pinned runs the scanner of a snapshot that is open for as long as the
+// loop runs
+func (kv *KV) pinned(scan func(*Snapshot) *Scanner) *Scanner {
+	return &Scanner{scan: func(yield func([]byte, []byte) bool) error {
+		snap := kv.Snapshot()
+		defer snap.Close()
+		scanner := scan(snap)
+		for key, val := range scanner.All() {
+			if !yield(key, val) {
+				break
+			}
+		}
+		return scanner.Err()
+	}}
+}
+
+// NewCursor returns a cursor over the keys of the last commit. It holds a
+// snapshot, so it stays valid while writes go on, until it is closed.
+func (kv *KV) NewCursor() *Cursor {
+	snap := kv.Snapshot()
+	c := snap.NewCursor()
+	c.snap = snap
+	return c
+}
+
+// BulkLoad adds the sorted keys of kvs with a single commit, see
+// BTree.BulkLoad
+func (kv *KV) BulkLoad(kvs iter.Seq2[[]byte, []byte], fill float64) error {
+	if kv.storage.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	kv.storage.begin()
+	defer kv.storage.writer.Unlock()
+	saved := *kv.storage.Metadata
+	if err := kv.storage.tree.BulkLoad(kvs, fill); err != nil {
+		kv.storage.rollback(saved)
+		return err
+	}
+	if err := kv.storage.Sync(); err != nil {
+		kv.storage.rollback(saved)
+		return err
+	}
+	return nil
 }
 
 func (kv *KV) Delete(key []byte) error {
-	err := kv.storage.tree.Delete(key)
-	if err != nil {
-		return nil
+	batch := WriteBatch{}
+	batch.Delete(key)
+	return kv.Write(&batch)
+}
+
+// WriteBatch collects puts and deletes that are committed together
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	val    []byte
+	delete bool
+}
+
+func (b *WriteBatch) Put(key []byte, val []byte) {
+	b.ops = append(b.ops, batchOp{key: key, val: val})
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Write applies the batch in order and commits it with a single sync. If
+// one of the operations fails none of them is applied.
+func (kv *KV) Write(batch *WriteBatch) error {
+	if kv.storage.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	kv.storage.begin()
+	defer kv.storage.writer.Unlock()
+	saved := *kv.storage.Metadata
+	for _, op := range batch.ops {
+		var err error
+		if op.delete {
+			err = kv.storage.tree.Delete(op.key)
+		} else {
+			err = kv.storage.tree.Insert(op.key, op.val)
+		}
+		if err != nil {
+			kv.storage.rollback(saved)
+			return err
+		}
+	}
+	if err := kv.storage.Sync(); err != nil {
+		kv.storage.rollback(saved)
+		return err
 	}
-	return kv.storage.Sync()
+	return nil
 }
 
 type MMapStorage struct {
 	Path     string
+	Options  Options
 	Metadata *Metadata
 
-	// File and mmap
-	file *os.File
-	fd   int
-	tree BTree
-
-	mmap struct {
-		total  int      // total mmap'd bytes
-		chunks [][]byte // mmap chunks
-	}
+	// File and the committed pages in it
+	file  *os.File
+	fd    int
+	pages pageFile
+	tree  BTree
+	free  FreeList
 
 	page struct {
-		temp [][]byte // new pages in memory
+		temp    [][]byte          // new pages in memory
+		updates map[uint64][]byte // pages below Flushed rewritten in memory
+		reused  map[uint64]bool   // pages taken from the free list in this transaction
+		freed   []uint64          // committed pages released in this transaction
+		spare   []uint64          // uncommitted pages released in this transaction
 	}
 
-	failed bool // crash recovery flag
+	cipher     *pageCipher // nil unless the file is encrypted, see encrypt.go
+	gen        uint64      // generation of the last page writes
+	metaCommit uint64      // commit of the newest meta slot in the file
+
+	// Readers never see the pages of a transaction in progress, they read
+	// the tree of the last commit. writer serializes the transactions, mu
+	// guards what the writer shares with readers.
+	writer    sync.Mutex
+	mu        sync.RWMutex
+	committed Metadata       // meta of the last commit
+	pins      []*snapshotPin // of the open snapshots, oldest first
+	retired   []*retiredFile // replaced files that snapshots still read
+
+	wal *wal // nil unless Options.WAL is set
 }
 
 // Delete implements Storage.
 func (db *MMapStorage) Delete(ptr uint64) error {
-	// Pages are freed automatically by copy-on-write
-	// For now, no-op - we can implement free list later
+	// A page that was written in this transaction is not reachable from the
+	// last committed root and can be handed out again right away. Everything
+	// else is only recycled once the commit that dropped it is durable.
+	if ptr >= db.Metadata.Flushed || db.page.reused[ptr] {
+		db.page.spare = append(db.page.spare, ptr)
+		return nil
+	}
+	db.page.freed = append(db.page.freed, ptr)
 	return nil
 }
 
+// PageSize implements Storage. Nodes are smaller than the pages of the file
+// if the pages have a header.
+func (db *MMapStorage) PageSize() int {
+	return int(db.Metadata.PageSize) - db.pageHeader()
+}
+
 // Get implements Storage.
 func (db *MMapStorage) Get(ptr uint64) ([]byte, error) {
-	// Check temp pages first
+	// Check rewritten pages first
+	if page, ok := db.page.updates[ptr]; ok {
+		return page, nil
+	}
+
+	// Check temp pages
 	if ptr >= db.Metadata.Flushed {
 		idx := ptr - db.Metadata.Flushed
 		if int(idx) < len(db.page.temp) {
@@ -97,23 +303,73 @@ func (db *MMapStorage) Get(ptr uint64) ([]byte, error) {
 		}
 		return nil, fmt.Errorf("bad ptr")
 	}
+	return db.committedPage(ptr, db.Metadata)
+}
+
+// committedPage reads a page that is either still in the log or in the
+// file, it is safe to call while a transaction is in progress
+func (db *MMapStorage) committedPage(ptr uint64, meta *Metadata) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lockedPage(ptr, meta)
+}
+
+// lockedPage is committedPage for readers that hold mu
+func (db *MMapStorage) lockedPage(ptr uint64, meta *Metadata) ([]byte, error) {
+	page, pending, err := db.filePage(ptr, meta)
+	if err != nil || pending {
+		return page, err
+	}
+	return db.decodePage(ptr, page, meta)
+}
 
-	// Check mmap pages
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return chunk[offset : offset+BTREE_PAGE_SIZE], nil
+// filePage returns a committed page as it is in the file, header included.
+// Pages still in the log are pending and have no header. The caller holds
+// mu.
+func (db *MMapStorage) filePage(ptr uint64, meta *Metadata) (page []byte, pending bool, err error) {
+	// Check committed pages still in the log
+	if db.wal != nil {
+		if page, ok := db.wal.pending[ptr]; ok {
+			return page, true, nil
 		}
-		start = end
 	}
-	return nil, fmt.Errorf("bad ptr")
+
+	// Then the file
+	page, err = db.pages.read(int64(ptr*meta.PageSize), int(meta.PageSize))
+	return page, false, err
 }
 
 // New implements Storage.
 func (db *MMapStorage) New(node []byte) (uint64, error) {
-	if len(node) != BTREE_PAGE_SIZE {
+	if len(node) != db.PageSize() {
+		return 0, fmt.Errorf("invalid page size")
+	}
+
+	// Pages dropped earlier in this transaction first
+	if n := len(db.page.spare); n > 0 {
+		ptr := db.page.spare[n-1]
+		db.page.spare = db.page.spare[:n-1]
+		db.write(ptr, node)
+		return ptr, nil
+	}
+
+	// Then pages freed by earlier commits
+	ptr, ok, err := db.free.PopHead()
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		db.page.reused[ptr] = true
+		db.write(ptr, node)
+		return ptr, nil
+	}
+
+	return db.Append(node)
+}
+
+// Append implements ListStorage.
+func (db *MMapStorage) Append(node []byte) (uint64, error) {
+	if len(node) != db.PageSize() {
 		return 0, fmt.Errorf("invalid page size")
 	}
 	ptr := db.Metadata.Flushed + uint64(len(db.page.temp))
@@ -121,20 +377,87 @@ func (db *MMapStorage) New(node []byte) (uint64, error) {
 	return ptr, nil
 }
 
+// Update implements ListStorage.
+func (db *MMapStorage) Update(ptr uint64) ([]byte, error) {
+	if page, ok := db.page.updates[ptr]; ok {
+		return page, nil
+	}
+	if ptr >= db.Metadata.Flushed {
+		return db.Get(ptr)
+	}
+
+	// committed pages are read only, work on a copy until the next flush
+	page, err := db.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	copied := make([]byte, db.PageSize())
+	copy(copied, page)
+	db.page.updates[ptr] = copied
+	return copied, nil
+}
+
+func (db *MMapStorage) write(ptr uint64, node []byte) {
+	if ptr >= db.Metadata.Flushed {
+		db.page.temp[ptr-db.Metadata.Flushed] = node
+		return
+	}
+	db.page.updates[ptr] = node
+}
+
+// rollback drops the uncommitted changes and goes back to saved, the meta
+// of the last commit. It also undoes a commit whose sync failed, its pages
+// are then reused like any other uncommitted ones.
+func (db *MMapStorage) rollback(saved Metadata) {
+	*db.Metadata = saved
+	db.page.temp = nil
+	clear(db.page.updates)
+	clear(db.page.reused)
+	db.page.freed = nil
+	db.page.spare = nil
+}
+
+// releasePages moves every page dropped in this transaction onto the free
+// list. It must run before flushPages so the list pages are written with
+// the rest of the transaction.
+func (db *MMapStorage) releasePages() error {
+	for _, ptr := range db.page.freed {
+		if err := db.free.PushTail(ptr); err != nil {
+			return err
+		}
+	}
+	for _, ptr := range db.page.spare {
+		if err := db.free.PushTail(ptr); err != nil {
+			return err
+		}
+	}
+	db.page.freed = nil
+	db.page.spare = nil
+	return nil
+}
+
 func (db *MMapStorage) flushPages() error {
-	if len(db.page.temp) == 0 {
+	if len(db.page.temp) == 0 && len(db.page.updates) == 0 {
 		return nil
 	}
-
-	// Calculate file offset
-	offset := int64(db.Metadata.Flushed * BTREE_PAGE_SIZE)
+	gen, err := db.nextGeneration()
+	if err != nil {
+		return err
+	}
 
 	// Write all temp pages
-	for _, page := range db.page.temp {
-		if _, err := unix.Pwrite(db.fd, page, offset); err != nil {
-			return fmt.Errorf("pwrite page: %w", err)
+	for i, page := range db.page.temp {
+		ptr := db.Metadata.Flushed + uint64(i)
+		if err := db.writePage(ptr, page, db.Metadata, gen); err != nil {
+			return err
+		}
+	}
+
+	// Write reused pages in place
+	for ptr, page := range db.page.updates {
+		if err := db.writePage(ptr, page, db.Metadata, gen); err != nil {
+			return err
 		}
-		offset += int64(BTREE_PAGE_SIZE)
 	}
 
 	// Fsync file
@@ -145,81 +468,198 @@ func (db *MMapStorage) flushPages() error {
 	// Update flushed count
 	db.Metadata.Flushed += uint64(len(db.page.temp))
 
-	// Extend mmap if needed
-	newSize := int64(db.Metadata.Flushed * BTREE_PAGE_SIZE)
-	if int(newSize) > db.mmap.total {
-		if err := db.extendMmap(int(newSize)); err != nil {
-			return err
-		}
+	// Make the new pages readable
+	if err := db.extendFile(int(db.Metadata.Flushed * db.Metadata.PageSize)); err != nil {
+		return err
 	}
 
 	// Clear temp pages
 	db.page.temp = nil
+	clear(db.page.updates)
+	clear(db.page.reused)
 
 	return nil
 }
 
+// writePage writes node to the file, meta is passed in as checkpoints write
+// pages while the writer changes db.Metadata
+func (db *MMapStorage) writePage(ptr uint64, node []byte, meta *Metadata, gen uint64) error {
+	offset := int64(ptr * meta.PageSize)
+	page := db.encodePage(ptr, node, meta, gen)
+
+	// the padding of a compressed page is written as well, so the file
+	// grows by whole pages, and then turned into a hole
+	if _, err := unix.Pwrite(db.fd, page[:meta.PageSize], offset); err != nil {
+		return fmt.Errorf("pwrite page: %w", err)
+	}
+	if used := len(page); used < int(meta.PageSize) {
+		if err := db.punchHole(offset, used, int(meta.PageSize)); err != nil {
+			return err
+		}
+	}
+	db.mu.RLock()
+	db.pages.written(offset)
+	db.mu.RUnlock()
+	return nil
+}
+
 func (db *MMapStorage) Open() error {
 
-	// Step 2: Open/create file
-	f, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	// Step 1: Open/create file, see memory.go for storages in memory
+	f, err := db.openFile()
 	if err != nil {
-		return fmt.Errorf("open file: %w", err)
+		return err
 	}
 	db.file = f
 	db.fd = int(f.Fd())
 
+	// Step 2: Keep other processes from writing, see lock.go
+	if err := db.lock(); err != nil {
+		db.Close()
+		return err
+	}
+	db.page.updates = map[uint64][]byte{}
+	db.page.reused = map[uint64]bool{}
+
 	// Step 3: Get file size
-	stat, err := f.Stat()
+	stat, err := db.file.Stat()
 	if err != nil {
 		db.Close()
 		return fmt.Errorf("stat file: %w", err)
 	}
 	fileSize := stat.Size()
 
-	// Step 4: Validate file size is multiple of BTREE_PAGE_SIZE
+	// Step 4: Validate file size is multiple of the smallest page size, the
+	// actual one is checked once the meta page is loaded
 	if fileSize%BTREE_PAGE_SIZE != 0 {
 		db.Close()
 		return errors.New("file size not multiple of page size")
 	}
 
-	// Step 5: Create initial mmap
-	if err := db.extendMmap(int(fileSize)); err != nil {
+	// Step 5: Make the pages readable, see pagefile.go
+	db.pages = db.openPages()
+	if err := db.extendFile(int(fileSize)); err != nil {
 		db.Close()
-		return fmt.Errorf("extend mmap: %w", err)
+		return fmt.Errorf("extend file: %w", err)
 	}
 
 	// Step 6: Handle empty file - create new database
 	if fileSize == 0 {
-		db.Metadata = NewMetadata(make([]byte, BTREE_PAGE_SIZE))
+		if db.Options.ReadOnly {
+			db.Close()
+			return errors.New("empty file opened read-only")
+		}
+		pageSize := db.Options.PageSize
+		if pageSize == 0 {
+			pageSize = BTREE_PAGE_SIZE
+		}
+		if !ValidPageSize(pageSize) {
+			db.Close()
+			return fmt.Errorf("unsupported page size: %d", pageSize)
+		}
+		db.Metadata = NewMetadata(make([]byte, META_SIZE))
+		db.Metadata.PageSize = uint64(pageSize)
 		db.Metadata.Flushed = 1 // Meta page is page 0
-		db.tree, err = NewBTree(db, db.Metadata)
+		db.Metadata.Flags |= FORMAT_PAGE_CHECKSUMS | FORMAT_META_SLOTS | FORMAT_PAGE_VERSIONS
+		if db.Options.PrefixLeaves {
+			db.Metadata.Flags |= FORMAT_PREFIX_LEAVES
+		}
+		if db.Options.Compression != CODEC_NONE {
+			if err := checkCodec(db.Options.Compression); err != nil {
+				db.Close()
+				return err
+			}
+			db.Metadata.Flags |= FORMAT_COMPRESSED
+			db.Metadata.Codec = db.Options.Compression
+		}
+		if err := db.newCipher(); err != nil {
+			db.Close()
+			return err
+		}
+		if db.cipher != nil {
+			// the first commit makes the reservation durable, the file is
+			// not valid before anyway
+			db.reserveGenerations(db.Metadata.Commit + 1)
+		}
+		db.free, err = NewFreeList(db, db.Metadata)
 		if err != nil {
+			db.Close()
 			return err
 		}
-		if err := db.flushPages(); err != nil {
+		db.tree, err = NewBTree(db, db.Metadata)
+		if err != nil {
 			db.Close()
 			return err
 		}
-		if err := db.writeMetaPage(); err != nil {
+		if err := db.Sync(); err != nil {
 			db.Close()
 			return err
 		}
-		return nil
+		return db.startWAL()
 	}
 
-	// Step 7: Load existing meta
-	metaData := db.mmap.chunks[0][:META_SIZE]
-	db.Metadata = NewMetadata(metaData)
+	// Step 7: Load the newest valid meta slot
+	metaPage := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := db.file.ReadAt(metaPage, 0); err != nil {
+		db.Close()
+		return fmt.Errorf("read meta page: %w", err)
+	}
+	db.Metadata, err = LoadMetadata(metaPage)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	db.metaCommit = db.Metadata.Commit
 
 	// Step 8: Validate meta page
-	sig := string(metaData[:14])
-	if sig != DB_SIG {
+	if db.Metadata.Flags&^FORMAT_KNOWN != 0 {
+		db.Close()
+		return fmt.Errorf("unsupported format flags: %#x", db.Metadata.Flags)
+	}
+	if db.Metadata.Flags&FORMAT_COMPRESSED != 0 {
+		if err := checkCodec(db.Metadata.Codec); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	pageSize := int64(db.Metadata.PageSize)
+	if !ValidPageSize(int(pageSize)) {
+		db.Close()
+		return fmt.Errorf("unsupported page size: %d", pageSize)
+	}
+	if db.Options.PageSize != 0 && int64(db.Options.PageSize) != pageSize {
+		db.Close()
+		return fmt.Errorf("file has %d byte pages, not %d", pageSize, db.Options.PageSize)
+	}
+	if fileSize%pageSize != 0 {
+		db.Close()
+		return errors.New("file size not multiple of page size")
+	}
+	if err := db.openCipher(); err != nil {
 		db.Close()
-		return errors.New("bad meta signature")
+		return err
+	}
+	if db.cipher != nil && !db.Options.ReadOnly {
+		if err := db.writeMetaPage(); err != nil {
+			db.Close()
+			return err
+		}
+		db.reserveGenerations(db.Metadata.Commit)
 	}
 
-	maxPages := uint64(fileSize / BTREE_PAGE_SIZE)
+	// Step 9: Apply commits that are only in the log
+	if err := db.recoverWAL(); err != nil {
+		db.Close()
+		return err
+	}
+	if stat, err = db.file.Stat(); err != nil {
+		db.Close()
+		return fmt.Errorf("stat file: %w", err)
+	}
+	fileSize = stat.Size()
+
+	maxPages := uint64(fileSize / pageSize)
 	if !(0 < db.Metadata.Flushed && db.Metadata.Flushed <= maxPages) {
 		db.Close()
 		return errors.New("bad flushed count")
@@ -230,79 +670,155 @@ func (db *MMapStorage) Open() error {
 		return errors.New("bad root pointer")
 	}
 
-	// Step 9: Create BTree with loaded root
-	db.tree, err = NewBTree(db, db.Metadata)
-	if err != nil {
-		return err
+	// Step 10: Attach BTree and free list to the loaded meta
+	db.tree = BTree{metaData: db.Metadata, storage: db}
+	if db.Metadata.HeadPage == 0 && !db.Options.ReadOnly {
+		// files written before page reuse have no free list yet
+		db.free, err = NewFreeList(db, db.Metadata)
+		if err != nil {
+			db.Close()
+			return err
+		}
+	} else {
+		db.free = FreeList{storage: db, metadata: db.Metadata}
 	}
-	db.Metadata.Root = binary.LittleEndian.Uint64(metaData[16:24])
 
-	// Step 10: Return success
-	return nil
+	db.publish()
+
+	// Step 11: Commit to the log from now on
+	return db.startWAL()
 }
 
-func (db *MMapStorage) writeMetaPage() error {
-	metaBytes := db.Metadata.Save()
-	_, err := unix.Pwrite(db.fd, metaBytes, 0)
+func (db *MMapStorage) openFile() (*os.File, error) {
+	if db.inMemory() {
+		if db.Path != "" {
+			return nil, errors.New("in-memory storage with a path")
+		}
+		return openMemory()
+	}
+	if db.Path == "" {
+		return nil, errors.New("open file: empty path")
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if db.Options.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(db.Path, flag, 0o644)
 	if err != nil {
-		return fmt.Errorf("write meta page: %w", err)
+		return nil, fmt.Errorf("open file: %w", err)
 	}
-	if err := unix.Fsync(db.fd); err != nil {
-		return fmt.Errorf("fsync meta page: %w", err)
+	return f, nil
+}
+
+func (db *MMapStorage) startWAL() error {
+	if !db.Options.WAL || db.Options.ReadOnly || db.inMemory() {
+		return nil
+	}
+	if err := db.openWAL(); err != nil {
+		db.Close()
+		return err
 	}
 	return nil
 }
 
-func (db *MMapStorage) extendMmap(size int) error {
-	if size <= db.mmap.total {
-		return nil // enough range
+// begin starts a write transaction, writers wait for each other. The free
+// list stops at the oldest snapshot for the whole transaction. Snapshots
+// taken meanwhile pin the last commit, the pages on the free list at its
+// start were freed before that.
+func (db *MMapStorage) begin() {
+	db.writer.Lock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.free.limit = nil
+	if len(db.pins) > 0 {
+		db.free.limit = &db.pins[0].pos
 	}
+}
 
-	// Start with 1MB, double as needed
-	alloc := INITIAL_MMAP_MB << 20 // 1MB
-	if db.mmap.total > 0 {
-		alloc = db.mmap.total
-	}
+// publish makes the meta of a commit the one readers use
+func (db *MMapStorage) publish() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.committed = *db.Metadata
+}
 
-	for db.mmap.total+alloc < size {
-		alloc *= 2
-	}
+// committedTree returns the tree of the last commit
+func (db *MMapStorage) committedTree() BTree {
+	db.mu.RLock()
+	meta := db.committed
+	db.mu.RUnlock()
+	return BTree{metaData: &meta, storage: readView{db: db, meta: &meta}}
+}
+
+// writeMetaPage commits the transaction by writing the meta to the slot the
+// last commit did not use
+func (db *MMapStorage) writeMetaPage() error {
+	return db.writeMeta(db.Metadata)
+}
 
-	chunk, err := unix.Mmap(
-		db.fd, int64(db.mmap.total), alloc,
-		unix.PROT_READ, unix.MAP_SHARED,
-	)
+func (db *MMapStorage) writeMeta(meta *Metadata) error {
+	// files written before the slots are switched over on their first commit
+	meta.Flags |= FORMAT_META_SLOTS
+	// every write goes to the other slot with a newer commit than the one
+	// there, also if no commit happened in between
+	commit := max(meta.Commit, db.metaCommit+1)
+	if (commit-db.metaCommit)%2 == 0 {
+		commit++
+	}
+	meta.Commit = commit
+	metaBytes := meta.Save()
+	_, err := unix.Pwrite(db.fd, metaBytes, meta.SlotOffset())
 	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+		return fmt.Errorf("write meta page: %w", err)
 	}
-
-	db.mmap.total += alloc
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	if err := unix.Fsync(db.fd); err != nil {
+		return fmt.Errorf("fsync meta page: %w", err)
+	}
+	db.metaCommit = commit
 	return nil
 }
 
 func (db *MMapStorage) Sync() error {
-	if err := db.flushPages(); err != nil {
+	db.Metadata.Commit++
+	if err := db.releasePages(); err != nil {
 		return err
 	}
-	if err := db.writeMetaPage(); err != nil {
-		return err
+	if db.wal != nil {
+		if err := db.logCommit(); err != nil {
+			return err
+		}
+	} else {
+		if err := db.flushPages(); err != nil {
+			return err
+		}
+		if err := db.writeMetaPage(); err != nil {
+			return err
+		}
 	}
+	db.publish()
 	return nil
 }
 
 func (db *MMapStorage) Close() error {
-	for _, chunk := range db.mmap.chunks {
-		if err := unix.Munmap(chunk); err != nil {
-			return fmt.Errorf("munmap: %w", err)
-		}
+	var err error
+	if db.wal != nil {
+		err = db.closeWAL()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pages != nil {
+		err = errors.Join(err, db.pages.close())
 	}
 	if db.file != nil {
-		if err := db.file.Close(); err != nil {
-			return fmt.Errorf("close file: %w", err)
+		if cerr := db.file.Close(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("close file: %w", cerr))
 		}
 	}
-	return nil
+	for _, retired := range db.retired {
+		err = errors.Join(err, retired.storage.Close())
+	}
+	db.retired = nil
+	return err
 }
 
-var _ Storage = (*MMapStorage)(nil)
+var _ ListStorage = (*MMapStorage)(nil)
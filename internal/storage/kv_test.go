@@ -1,9 +1,14 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestKVBasic demonstrates the basic setup for integration testing
@@ -150,7 +155,7 @@ func TestKVMmapChunks(t *testing.T) {
 	defer db.Close()
 
 	// Check initial mmap chunks
-	initialChunks := len(db.mmap.chunks)
+	initialChunks := len(db.pages.(*mmapFile).chunks)
 	t.Logf("Initial mmap chunks: %d", initialChunks)
 
 	// Insert a key-value pair
@@ -159,7 +164,7 @@ func TestKVMmapChunks(t *testing.T) {
 	}
 
 	// Check mmap chunks after insert
-	afterInsertChunks := len(db.mmap.chunks)
+	afterInsertChunks := len(db.pages.(*mmapFile).chunks)
 	t.Logf("Mmap chunks after insert: %d", afterInsertChunks)
 
 	// For now, we should have at least the initial chunk
@@ -233,3 +238,1082 @@ func TestKVBadFile(t *testing.T) {
 
 	t.Log("bad file test passed")
 }
+
+// TestKVReusesFreedPages checks that overwriting the same keys does not grow the file
+func TestKVReusesFreedPages(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	for i := range 200 {
+		key := []byte{byte(i % 4)}
+		if err := db.Insert(key, []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	for i := range 4 {
+		if err := db.Delete([]byte{byte(i)}); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+
+	flushed := db.storage.Metadata.Flushed
+	if flushed > 10 {
+		t.Fatalf("file should not grow with overwrites, has %d pages", flushed)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// The free list must survive a reopen
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	for i := range 200 {
+		if err := db.Insert([]byte{byte(i % 4)}, []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if db.storage.Metadata.Flushed != flushed {
+		t.Fatalf("file grew after reopen: %d -> %d pages", flushed, db.storage.Metadata.Flushed)
+	}
+}
+
+// TestKVFreedPagesWaitForCommit checks that committed pages are not reused before the next sync
+func TestKVFreedPagesWaitForCommit(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db := &MMapStorage{Path: dbPath}
+	if err := db.Open(); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	committed := db.Metadata.Root
+	if err := db.Delete(committed); err != nil {
+		t.Fatalf("failed to delete page: %v", err)
+	}
+
+	ptr, err := db.New(make([]byte, db.PageSize()))
+	if err != nil {
+		t.Fatalf("failed to allocate page: %v", err)
+	}
+	if ptr == committed {
+		t.Fatal("committed page must not be reused before sync")
+	}
+
+	// A page written and dropped in the same transaction can be reused at once
+	if err := db.Delete(ptr); err != nil {
+		t.Fatalf("failed to delete page: %v", err)
+	}
+	again, err := db.New(make([]byte, db.PageSize()))
+	if err != nil {
+		t.Fatalf("failed to allocate page: %v", err)
+	}
+	if again != ptr {
+		t.Fatalf("uncommitted page should be reused, got %d want %d", again, ptr)
+	}
+
+	if err := db.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	reused, err := db.New(make([]byte, db.PageSize()))
+	if err != nil {
+		t.Fatalf("failed to allocate page: %v", err)
+	}
+	if reused != committed {
+		t.Fatalf("freed page should be reused after sync, got %d want %d", reused, committed)
+	}
+}
+
+// TestKVLargeValue stores values spanning several overflow pages
+func TestKVLargeValue(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	doc := bytes.Repeat([]byte(`{"name":"value"}`), 4000)
+	if err := db.Insert([]byte("doc"), doc); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	val, ok, err := db.Get([]byte("doc"))
+	if err != nil || !ok {
+		t.Fatalf("failed to get doc: %v, ok=%v", err, ok)
+	}
+	if !bytes.Equal(val, doc) {
+		t.Fatalf("value mismatch, got %d bytes want %d", len(val), len(doc))
+	}
+
+	flushed := db.storage.Metadata.Flushed
+	for range 10 {
+		if err := db.Insert([]byte("doc"), doc); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if db.storage.Metadata.Flushed > flushed+20 {
+		t.Fatalf("overflow pages should be reused, file grew %d -> %d pages", flushed, db.storage.Metadata.Flushed)
+	}
+}
+
+// TestKVPrefixLeavesFormat checks that the format flag is kept in the file
+func TestKVPrefixLeavesFormat(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKVWithOptions(dbPath, Options{PrefixLeaves: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert key1: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// Options only apply to new files
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	if db.storage.Metadata.Flags&FORMAT_PREFIX_LEAVES == 0 {
+		t.Fatal("format flag should be kept")
+	}
+	data, _ := db.storage.Get(db.storage.Metadata.Root)
+	if !BNode(data).prefixed() {
+		t.Fatal("root leaf should be prefixed")
+	}
+	val, ok, err := db.Get([]byte("key1"))
+	if err != nil || !ok || string(val) != "value1" {
+		t.Fatalf("key1 mismatch: got %s, ok=%v, err=%v", val, ok, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// Files with flags from the future are rejected
+	db.storage.Metadata.Flags = 1 << 63
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	if _, err := f.WriteAt(db.storage.Metadata.Save(), db.storage.Metadata.SlotOffset()); err != nil {
+		t.Fatalf("failed to write meta: %v", err)
+	}
+	f.Close()
+	if _, err := NewKV(dbPath); err == nil {
+		t.Fatal("should reject unknown format flags")
+	}
+}
+
+// TestKVPageSize checks that the page size is kept in the file
+func TestKVPageSize(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKVWithOptions(dbPath, Options{PageSize: 16384})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	val := bytes.Repeat([]byte("v"), 10000) // inline with 16K pages
+	for i := range 100 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatalf("failed to insert key%d: %v", i, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	stat, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+	if stat.Size()%16384 != 0 {
+		t.Fatalf("file size %d is not a multiple of the page size", stat.Size())
+	}
+
+	// Files are opened with the size they were created with
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	if db.storage.Metadata.PageSize != 16384 {
+		t.Fatalf("page size should be kept, got: %d", db.storage.Metadata.PageSize)
+	}
+	for i := range 100 {
+		got, ok, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || !ok || !bytes.Equal(got, val) {
+			t.Fatalf("key%d mismatch: ok=%v, err=%v", i, ok, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	if _, err := NewKVWithOptions(dbPath, Options{PageSize: 8192}); err == nil {
+		t.Fatal("should reject a different page size")
+	}
+	if _, err := NewKVWithOptions(filepath.Join(tempDir, "bad.db"), Options{PageSize: 12288}); err == nil {
+		t.Fatal("should reject a page size that is not a power of two")
+	}
+}
+
+// TestKVDetectsCorruptPage flips a bit of a page on disk and expects the read
+// to fail with the page number
+func TestKVDetectsCorruptPage(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert key1: %v", err)
+	}
+	root := db.storage.Metadata.Root
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	buf := make([]byte, 1)
+	offset := int64(root*BTREE_PAGE_SIZE) + PAGE_HEADER + 20
+	f.ReadAt(buf, offset)
+	buf[0] ^= 0x01
+	if _, err := f.WriteAt(buf, offset); err != nil {
+		t.Fatalf("failed to corrupt page: %v", err)
+	}
+	f.Close()
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	_, _, err = db.Get([]byte("key1"))
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("should report corruption, got: %v", err)
+	}
+	if corrupt.Page != root {
+		t.Fatalf("should report page %d, got: %d", root, corrupt.Page)
+	}
+
+	scanner := db.NewScanner(nil, nil)
+	for range scanner.All() {
+		t.Fatal("should not yield keys of a corrupt page")
+	}
+	if !errors.As(scanner.Err(), &corrupt) {
+		t.Fatalf("scan should report corruption, got: %v", scanner.Err())
+	}
+}
+
+// TestKVTornMetaFallsBack destroys the slot of the last commit and expects
+// the commit before it
+func TestKVTornMetaFallsBack(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert key1: %v", err)
+	}
+	if err := db.Insert([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatalf("failed to insert key2: %v", err)
+	}
+	last := *db.storage.Metadata
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	torn := last.Save()[:40]
+	if _, err := f.WriteAt(append(torn, make([]byte, META_SIZE-40)...), last.SlotOffset()); err != nil {
+		t.Fatalf("failed to tear meta: %v", err)
+	}
+	f.Close()
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	if db.storage.Metadata.Commit != last.Commit-1 {
+		t.Fatalf("should use commit %d, got: %d", last.Commit-1, db.storage.Metadata.Commit)
+	}
+	if _, ok, err := db.Get([]byte("key1")); err != nil || !ok {
+		t.Fatalf("key1 should exist: ok=%v, err=%v", ok, err)
+	}
+	if _, ok, err := db.Get([]byte("key2")); err != nil || ok {
+		t.Fatalf("key2 should not exist: ok=%v, err=%v", ok, err)
+	}
+
+	// the next commit goes to the torn slot again
+	if err := db.Insert([]byte("key3"), []byte("value3")); err != nil {
+		t.Fatalf("failed to insert key3: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if _, ok, err := db.Get([]byte("key3")); err != nil || !ok {
+		t.Fatalf("key3 should exist: ok=%v, err=%v", ok, err)
+	}
+}
+
+// TestKVMetaWritesAlternate writes the meta of one commit twice, like a
+// checkpoint without commits since the last one, and expects both slots to
+// stay valid with the newer one loaded
+func TestKVMetaWritesAlternate(t *testing.T) {
+	db, err := NewKV(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	meta := *db.storage.Metadata
+	for range 3 {
+		before := meta
+		if err := db.storage.writeMeta(&meta); err != nil {
+			t.Fatalf("failed to write meta: %v", err)
+		}
+		if meta.Commit <= before.Commit || meta.SlotOffset() == before.SlotOffset() {
+			t.Fatalf("meta should be written with a newer commit to the other slot, got: %d after %d", meta.Commit, before.Commit)
+		}
+
+		page := make([]byte, BTREE_PAGE_SIZE)
+		if _, err := db.storage.file.ReadAt(page, 0); err != nil {
+			t.Fatalf("failed to read meta page: %v", err)
+		}
+		loaded, err := LoadMetadata(page)
+		if err != nil || loaded.Commit != meta.Commit {
+			t.Fatalf("should load commit %d, got: %+v, %v", meta.Commit, loaded, err)
+		}
+	}
+}
+
+// copyFile copies src to dst, used to capture the files of an open database
+// like a crash would leave them
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", src, err)
+	}
+	if err := os.WriteFile(dst, data, 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", dst, err)
+	}
+}
+
+// TestKVWALRecoversAfterCrash copies the files of an open database in WAL
+// mode and expects the copy to have all commits
+func TestKVWALRecoversAfterCrash(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKVWithOptions(dbPath, Options{WAL: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := range 100 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("failed to insert key%d: %v", i, err)
+		}
+	}
+	if err := db.Delete([]byte("key050")); err != nil {
+		t.Fatalf("failed to delete key050: %v", err)
+	}
+
+	// no checkpoint so far, all commits are only in the log
+	crashPath := filepath.Join(tempDir, "crash.db")
+	copyFile(t, dbPath, crashPath)
+	copyFile(t, dbPath+WAL_SUFFIX, crashPath+WAL_SUFFIX)
+
+	crashed, err := NewKV(crashPath)
+	if err != nil {
+		t.Fatalf("failed to recover database: %v", err)
+	}
+	for i := range 100 {
+		val, ok, err := crashed.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil {
+			t.Fatalf("failed to get key%d: %v", i, err)
+		}
+		if ok != (i != 50) {
+			t.Fatalf("key%d exists: %v", i, ok)
+		}
+		if ok && string(val) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("key%d mismatch: got %s", i, val)
+		}
+	}
+	if err := crashed.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	if _, err := os.Stat(crashPath + WAL_SUFFIX); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("log should be removed after recovery: %v", err)
+	}
+}
+
+// TestKVWALTornCommit cuts the last record of the log and expects the
+// commit before it
+func TestKVWALTornCommit(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKVWithOptions(dbPath, Options{WAL: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert key1: %v", err)
+	}
+	before := db.storage.wal.size
+	if err := db.Insert([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatalf("failed to insert key2: %v", err)
+	}
+
+	crashPath := filepath.Join(tempDir, "crash.db")
+	copyFile(t, dbPath, crashPath)
+	copyFile(t, dbPath+WAL_SUFFIX, crashPath+WAL_SUFFIX)
+	if err := os.Truncate(crashPath+WAL_SUFFIX, before+100); err != nil {
+		t.Fatalf("failed to tear log: %v", err)
+	}
+
+	crashed, err := NewKV(crashPath)
+	if err != nil {
+		t.Fatalf("failed to recover database: %v", err)
+	}
+	defer crashed.Close()
+	if _, ok, err := crashed.Get([]byte("key1")); err != nil || !ok {
+		t.Fatalf("key1 should exist: ok=%v, err=%v", ok, err)
+	}
+	if _, ok, err := crashed.Get([]byte("key2")); err != nil || ok {
+		t.Fatalf("key2 should not exist: ok=%v, err=%v", ok, err)
+	}
+}
+
+// TestKVWALCheckpoint checkpoints after every commit and reopens the file
+// without WAL mode
+func TestKVWALCheckpoint(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKVWithOptions(dbPath, Options{WAL: true, CheckpointSize: 1})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	val := bytes.Repeat([]byte("v"), 500)
+	for i := range 500 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%03d", i)), val); err != nil {
+			t.Fatalf("failed to insert key%d: %v", i, err)
+		}
+	}
+	for i := range 250 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%03d", 2*i))); err != nil {
+			t.Fatalf("failed to delete key%d: %v", 2*i, err)
+		}
+	}
+	if len(db.storage.wal.pending) > 1000 {
+		t.Fatalf("checkpoints should drop pages from memory, has: %d", len(db.storage.wal.pending))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	for i := range 500 {
+		_, ok, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || ok != (i%2 == 1) {
+			t.Fatalf("key%d: ok=%v, err=%v", i, ok, err)
+		}
+	}
+}
+
+// logSize returns the bytes of both logs of a database
+func logSize(t *testing.T, dbPath string) int64 {
+	t.Helper()
+	total := int64(0)
+	for _, path := range []string{dbPath + WAL_SUFFIX, dbPath + WAL_OLD_SUFFIX} {
+		stat, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", path, err)
+		}
+		total += stat.Size()
+	}
+	return total
+}
+
+// TestKVWALStaysBounded commits while checkpoints run and expects them to
+// drop the log they covered
+func TestKVWALStaysBounded(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	const checkpointSize = 64 << 10
+	db, err := NewKVWithOptions(dbPath, Options{WAL: true, CheckpointSize: checkpointSize})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	val := bytes.Repeat([]byte("v"), 100)
+	largest := int64(0)
+	for i := range 5000 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%05d", i)), val); err != nil {
+			t.Fatalf("failed to insert key%d: %v", i, err)
+		}
+		largest = max(largest, logSize(t, dbPath))
+	}
+	// the log being checkpointed and the one after it, each four
+	// checkpoints and a commit at most
+	if limit := int64(10 * checkpointSize); largest > limit {
+		t.Fatalf("logs should stay below %d bytes, got: %d", limit, largest)
+	}
+	if len(db.storage.wal.pending) > 1000 {
+		t.Fatalf("checkpoints should drop pages from memory, has: %d", len(db.storage.wal.pending))
+	}
+}
+
+// TestKVWALRecoversBothLogs crashes while a checkpoint runs and expects the
+// commits of the old and the new log
+func TestKVWALRecoversBothLogs(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{WAL: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	insert := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatalf("failed to insert key%d: %v", i, err)
+			}
+		}
+	}
+	insert(0, 100)
+	// a checkpoint moves the log aside before it writes a page
+	db.storage.begin()
+	err = db.storage.rotateWAL()
+	db.storage.writer.Unlock()
+	if err != nil {
+		t.Fatalf("failed to rotate log: %v", err)
+	}
+	insert(100, 200)
+
+	crashPath := filepath.Join(tempDir, "crash.db")
+	copyFile(t, dbPath, crashPath)
+	copyFile(t, dbPath+WAL_OLD_SUFFIX, crashPath+WAL_OLD_SUFFIX)
+	copyFile(t, dbPath+WAL_SUFFIX, crashPath+WAL_SUFFIX)
+
+	crashed, err := NewKV(crashPath)
+	if err != nil {
+		t.Fatalf("failed to recover database: %v", err)
+	}
+	defer crashed.Close()
+	for i := range 200 {
+		val, ok, err := crashed.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || !ok || string(val) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("key%d should be recovered: %s, %v, %v", i, val, ok, err)
+		}
+	}
+	if err := crashed.Check().Err(); err != nil {
+		t.Fatalf("recovered database should pass the check: %v", err)
+	}
+	for _, path := range []string{crashPath + WAL_SUFFIX, crashPath + WAL_OLD_SUFFIX} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s should be removed after recovery: %v", path, err)
+		}
+	}
+}
+
+// TestKVWriteBatch commits puts and deletes together
+func TestKVWriteBatch(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("old"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert old: %v", err)
+	}
+
+	commit := db.storage.Metadata.Commit
+	batch := WriteBatch{}
+	for i := range 1000 {
+		batch.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	batch.Delete([]byte("old"))
+	batch.Put([]byte("key0000"), []byte("updated"))
+	if err := db.Write(&batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	if db.storage.Metadata.Commit != commit+1 {
+		t.Fatalf("batch should be a single commit, has: %d", db.storage.Metadata.Commit-commit)
+	}
+
+	if _, ok, _ := db.Get([]byte("old")); ok {
+		t.Fatal("old should be deleted")
+	}
+	val, ok, err := db.Get([]byte("key0000"))
+	if err != nil || !ok || string(val) != "updated" {
+		t.Fatalf("key0000 mismatch: got %s, ok=%v, err=%v", val, ok, err)
+	}
+	val, ok, err = db.Get([]byte("key0999"))
+	if err != nil || !ok || string(val) != "value999" {
+		t.Fatalf("key0999 mismatch: got %s, ok=%v, err=%v", val, ok, err)
+	}
+}
+
+// TestKVWriteBatchFails expects nothing of a failed batch to be applied
+func TestKVWriteBatchFails(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert key1: %v", err)
+	}
+
+	batch := WriteBatch{}
+	for i := range 100 {
+		batch.Put([]byte(fmt.Sprintf("new%03d", i)), []byte("value"))
+	}
+	batch.Delete([]byte("key1"))
+	batch.Put(bytes.Repeat([]byte("k"), BTREE_MAX_KEY_SIZE+1), nil)
+	if err := db.Write(&batch); err == nil {
+		t.Fatal("batch with a too large key should fail")
+	}
+
+	if _, ok, _ := db.Get([]byte("new000")); ok {
+		t.Fatal("puts of a failed batch should not be applied")
+	}
+	if _, ok, _ := db.Get([]byte("key1")); !ok {
+		t.Fatal("deletes of a failed batch should not be applied")
+	}
+
+	// the next commit does not pick up anything of the failed batch
+	if err := db.Insert([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatalf("failed to insert key2: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	count := 0
+	for range db.Scan(nil, nil) {
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("should have key1 and key2, has: %d keys", count)
+	}
+}
+
+// TestKVSyncFails makes the sync of a batch fail and expects the next commit
+// to start from the one before it
+func TestKVSyncFails(t *testing.T) {
+	for _, opts := range []Options{{}, {WAL: true}} {
+		t.Run(fmt.Sprintf("WAL=%v", opts.WAL), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			for i := range 100 {
+				if err := db.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			before := *db.storage.Metadata
+
+			// writes to a descriptor opened for reading fail
+			readOnly, err := os.Open(dbPath)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			defer readOnly.Close()
+			fd, log := db.storage.fd, db.storage.file
+			if opts.WAL {
+				log = db.storage.wal.file
+				db.storage.wal.file = readOnly
+			} else {
+				db.storage.fd = int(readOnly.Fd())
+			}
+			batch := WriteBatch{}
+			for i := range 100 {
+				batch.Put([]byte(fmt.Sprintf("failed%03d", i)), []byte("value"))
+			}
+			batch.Delete([]byte("key000"))
+			if err := db.Write(&batch); err == nil {
+				t.Fatal("write should fail when the sync fails")
+			}
+			if opts.WAL {
+				db.storage.wal.file = log
+			} else {
+				db.storage.fd = fd
+			}
+			if *db.storage.Metadata != before {
+				t.Fatalf("meta should be back at the last commit, got: %+v, want: %+v", *db.storage.Metadata, before)
+			}
+
+			if err := db.Insert([]byte("after"), []byte("value")); err != nil {
+				t.Fatalf("failed to insert after the failed sync: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close database: %v", err)
+			}
+			db, err = NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			if _, ok, _ := db.Get([]byte("failed000")); ok {
+				t.Fatal("puts of the failed batch should not be committed later")
+			}
+			if _, ok, _ := db.Get([]byte("key000")); !ok {
+				t.Fatal("deletes of the failed batch should not be committed later")
+			}
+			if _, ok, _ := db.Get([]byte("after")); !ok {
+				t.Fatal("commit after the failed sync should be there")
+			}
+			if err := db.Check().Err(); err != nil {
+				t.Fatalf("check should not find problems: %v", err)
+			}
+		})
+	}
+}
+
+// TestKVScanReverse reads the latest entries of a prefix
+func TestKVScanReverse(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	batch := WriteBatch{}
+	for i := range 100 {
+		batch.Put([]byte(fmt.Sprintf("event-%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	batch.Put([]byte("other"), []byte("value"))
+	if err := db.Write(&batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+
+	latest := []string{}
+	for k := range db.ScanReverse(Inclusive([]byte("event-")), Exclusive([]byte("event."))) {
+		latest = append(latest, string(k))
+		if len(latest) == 3 {
+			break
+		}
+	}
+	want := []string{"event-099", "event-098", "event-097"}
+	for i := range want {
+		if i >= len(latest) || latest[i] != want[i] {
+			t.Fatalf("latest events should be %v, got: %v", want, latest)
+		}
+	}
+}
+
+// TestKVConcurrentReaders runs readers while two writers commit, a reader
+// must see all keys of a single commit
+func TestKVConcurrentReaders(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{WAL: true, CheckpointSize: 64 << 10},
+		{Backend: BACKEND_PREAD, CacheSize: 16 << 10},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			db, err := NewKVWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			defer db.Close()
+
+			write := func(round int) error {
+				batch := WriteBatch{}
+				for i := range 200 {
+					batch.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("round-%06d", round)))
+				}
+				return db.Write(&batch)
+			}
+			if err := write(0); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+
+			read := func() error {
+				var round []byte
+				count := 0
+				scanner := db.NewScanner(nil, nil)
+				for _, val := range scanner.All() {
+					if round != nil && !bytes.Equal(val, round) {
+						return fmt.Errorf("scan sees %s and %s", round, val)
+					}
+					round = val
+					count++
+				}
+				if err := scanner.Err(); err != nil {
+					return err
+				}
+				if count != 200 {
+					return fmt.Errorf("scan sees %d keys", count)
+				}
+				if _, ok, err := db.Get([]byte("key-0100")); err != nil || !ok {
+					return fmt.Errorf("failed to get key: %v", err)
+				}
+				return nil
+			}
+
+			var writers, readers sync.WaitGroup
+			done := make(chan struct{})
+			errs := make(chan error, 6)
+			for w := range 2 {
+				writers.Go(func() {
+					for i := range 50 {
+						if err := write(1000*(w+1) + i); err != nil {
+							errs <- err
+							return
+						}
+					}
+				})
+			}
+			for range 4 {
+				readers.Go(func() {
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if err := read(); err != nil {
+							errs <- err
+							return
+						}
+					}
+				})
+			}
+			writers.Wait()
+			close(done)
+			readers.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKVFileLock(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if _, err := NewKV(dbPath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second writer should fail with ErrLocked, got: %v", err)
+	}
+	if _, err := NewKVWithOptions(dbPath, Options{ReadOnly: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("reader should fail while a writer has the file, got: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// readers share the file
+	var readers []*KV
+	for range 2 {
+		reader, err := NewKVWithOptions(dbPath, Options{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("failed to open database read-only: %v", err)
+		}
+		readers = append(readers, reader)
+	}
+	if val, ok, err := readers[1].Get([]byte("key")); err != nil || !ok || string(val) != "value" {
+		t.Fatalf("reader should see the value, got: %s, err: %v", val, err)
+	}
+	if err := readers[0].Insert([]byte("key"), []byte("other")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("insert should fail with ErrReadOnly, got: %v", err)
+	}
+	if _, err := NewKV(dbPath); !errors.Is(err, ErrLocked) {
+		t.Fatalf("writer should fail while readers have the file, got: %v", err)
+	}
+
+	// a waiting writer gets the file once the readers are gone
+	opened := make(chan error, 1)
+	go func() {
+		db, err := NewKVWithOptions(dbPath, Options{WaitForLock: true})
+		if err == nil {
+			err = db.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatalf("writer should wait for the readers, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, reader := range readers {
+		reader.Close()
+	}
+	if err := <-opened; err != nil {
+		t.Fatalf("waiting writer failed: %v", err)
+	}
+
+	if _, err := NewKVWithOptions(filepath.Join(t.TempDir(), "missing.db"), Options{ReadOnly: true}); err == nil {
+		t.Fatal("should not create a file read-only")
+	}
+}
+
+// TestKVReadOnlyWithoutFreeList opens a file written before page reuse and
+// expects a reader to leave it as it is
+func TestKVReadOnlyWithoutFreeList(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	meta := *db.storage.Metadata
+	meta.HeadPage, meta.HeadSeq, meta.TailPage, meta.TailSeq = 0, 0, 0, 0
+	if err := db.storage.writeMeta(&meta); err != nil {
+		t.Fatalf("failed to write meta: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	before, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+
+	reader, err := NewKVWithOptions(dbPath, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to open database read-only: %v", err)
+	}
+	if val, ok, err := reader.Get([]byte("key")); err != nil || !ok || string(val) != "value" {
+		t.Fatalf("reader should see the value, got: %s, err: %v", val, err)
+	}
+	if reader.storage.Metadata.HeadPage != 0 || len(reader.storage.page.temp) != 0 {
+		t.Fatalf("reader should not add a free list, head: %d", reader.storage.Metadata.HeadPage)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	after, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("reader should not grow the file, was: %d, is: %d", before.Size(), after.Size())
+	}
+}
+
+// TestKVWALCloseFails makes the last checkpoint fail and expects the log to
+// be closed anyway and replayed on the next open
+func TestKVWALCloseFails(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{WAL: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for i := range 100 {
+		if err := db.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// writes to a descriptor opened for reading fail
+	readOnly, err := os.Open(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer readOnly.Close()
+	db.storage.fd = int(readOnly.Fd())
+	log := db.storage.wal.file
+	if err := db.Close(); err == nil {
+		t.Fatal("close should fail when the checkpoint fails")
+	}
+	if err := log.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("close should close the log, got: %v", err)
+	}
+	if err := db.storage.file.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("close should close the file, got: %v", err)
+	}
+
+	db, err = NewKV(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	for i := range 100 {
+		if _, ok, err := db.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil || !ok {
+			t.Fatalf("key%d should be recovered from the log: %v, %v", i, ok, err)
+		}
+	}
+}
@@ -3,26 +3,51 @@ package storage
 import "encoding/binary"
 
 type FreeList struct {
-	storage  Storage
+	storage  ListStorage
 	metadata *Metadata
+
+	// limit is a position PopHead does not go past, the pages pushed from
+	// there on can still be reached by a snapshot
+	limit *listPos
+}
+
+// listPos is a position in the list, like HeadPage and HeadSeq
+type listPos struct {
+	page uint64
+	seq  uint64
+}
+
+// ListStorage is the page access the free list needs. Update hands out a
+// writable version of an existing page and Append always grows the file, so
+// the list never has to allocate from itself.
+type ListStorage interface {
+	Storage
+	Update(uint64) ([]byte, error)
+	Append([]byte) (uint64, error)
 }
 
 const FREE_LIST_HEADER = 8
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
-func SequenceToIndex(seq uint64) int {
-	return int(seq % FREE_LIST_CAP)
+// capacity is the number of pointers in a list node
+func (fl *FreeList) capacity() int {
+	return (fl.storage.PageSize() - FREE_LIST_HEADER) / 8
 }
 
-func NewFreeList(storage Storage, metadata *Metadata) (FreeList, error) {
-	head := LNode(make([]byte, BTREE_PAGE_SIZE))
-	idx, err := storage.New(head)
+func (fl *FreeList) SequenceToIndex(seq uint64) int {
+	return int(seq % uint64(fl.capacity()))
+}
+
+func NewFreeList(storage ListStorage, metadata *Metadata) (FreeList, error) {
+	head := LNode(make([]byte, storage.PageSize()))
+	idx, err := storage.Append(head)
 	if err != nil {
 		return FreeList{}, err
 
 	}
 	metadata.HeadPage = idx
+	metadata.HeadSeq = 0
 	metadata.TailPage = idx
+	metadata.TailSeq = 0
 	return FreeList{
 		storage:  storage,
 		metadata: metadata,
@@ -53,6 +78,9 @@ func (fl *FreeList) PopHead() (uint64, bool, error) {
 			return 0, false, nil
 		}
 	}
+	if fl.limit != nil && fl.metadata.HeadPage == fl.limit.page && fl.metadata.HeadSeq == fl.limit.seq {
+		return 0, false, nil
+	}
 	headPtr := fl.metadata.HeadPage
 	headPage, err := fl.storage.Get(headPtr)
 	if err != nil {
@@ -60,10 +88,13 @@ func (fl *FreeList) PopHead() (uint64, bool, error) {
 	}
 	node := LNode(headPage)
 	result := node.getPtr(int(fl.metadata.HeadSeq))
-	fl.metadata.HeadSeq = uint64(SequenceToIndex(fl.metadata.HeadSeq + 1))
+	fl.metadata.HeadSeq = uint64(fl.SequenceToIndex(fl.metadata.HeadSeq + 1))
 	if fl.metadata.HeadSeq == 0 {
 		fl.metadata.HeadPage = node.getNext()
-
+		// the drained list node is garbage now, hand it back like any other page
+		if err := fl.storage.Delete(headPtr); err != nil {
+			return 0, false, err
+		}
 	}
 
 	return result, true, nil
@@ -71,16 +102,16 @@ func (fl *FreeList) PopHead() (uint64, bool, error) {
 
 func (fl *FreeList) PushTail(ptr uint64) error {
 	tailPtr := fl.metadata.TailPage
-	tailPage, err := fl.storage.Get(tailPtr)
+	tailPage, err := fl.storage.Update(tailPtr)
 	if err != nil {
 		return err
 	}
 	node := LNode(tailPage)
 	node.setPtr(int(fl.metadata.TailSeq), ptr)
-	fl.metadata.TailSeq = uint64(SequenceToIndex(fl.metadata.TailSeq + 1))
+	fl.metadata.TailSeq = uint64(fl.SequenceToIndex(fl.metadata.TailSeq + 1))
 
 	if fl.metadata.TailSeq == 0 {
-		nextPtr, err := fl.storage.New(make([]byte, BTREE_PAGE_SIZE))
+		nextPtr, err := fl.storage.Append(make([]byte, fl.storage.PageSize()))
 		if err != nil {
 			return err
 		}
@@ -95,7 +95,7 @@ func TestFreeListInsertUntilNewPage(t *testing.T) {
 	if err != nil {
 		t.Fatalf("should not raised err: %v", err)
 	}
-	for i := range FREE_LIST_CAP {
+	for i := range list.capacity() {
 		err = list.PushTail(uint64(i))
 		if err != nil {
 			t.Fatalf("should not raised err: %v", err)
@@ -107,12 +107,12 @@ func TestFreeListInsertUntilNewPage(t *testing.T) {
 	}
 
 	storage.DumpPages()
-	err = list.PushTail(FREE_LIST_CAP)
+	err = list.PushTail(uint64(list.capacity()))
 	if err != nil {
 		t.Fatalf("should not raised err: %v", err)
 	}
 
-	for i := range FREE_LIST_CAP + 1 {
+	for i := range list.capacity() + 1 {
 		val, found, err := list.PopHead()
 		if !found {
 			t.Fatalf("should found value")
@@ -126,3 +126,38 @@ func TestFreeListInsertUntilNewPage(t *testing.T) {
 		}
 	}
 }
+
+func TestFreeListLimit(t *testing.T) {
+	storage := &MockStorage{
+		testing: t,
+		storage: map[uint64][]byte{}}
+	list, err := NewFreeList(storage, NewMetadata(make([]byte, BTREE_PAGE_SIZE)))
+	if err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
+	for i := range list.capacity() {
+		if err := list.PushTail(uint64(i)); err != nil {
+			t.Fatalf("should not raised err: %v", err)
+		}
+	}
+	list.limit = &listPos{page: list.metadata.TailPage, seq: list.metadata.TailSeq}
+	if err := list.PushTail(uint64(list.capacity())); err != nil {
+		t.Fatalf("should not raised err: %v", err)
+	}
+
+	for i := range list.capacity() {
+		val, found, err := list.PopHead()
+		if err != nil || !found || val != uint64(i) {
+			t.Fatalf("should have: %d got: %d found: %v", i, val, found)
+		}
+	}
+	if _, found, _ := list.PopHead(); found {
+		t.Fatalf("should not pop past the limit")
+	}
+
+	list.limit = nil
+	val, found, err := list.PopHead()
+	if err != nil || !found || val != uint64(list.capacity()) {
+		t.Fatalf("should have: %d got: %d found: %v", list.capacity(), val, found)
+	}
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Only one process may write a file. Open takes an exclusive flock for
+// writers and a shared one for read-only openers, the lock goes away with
+// the file descriptor when the file is closed or the process dies.
+
+// ErrLocked is returned by Open if another process holds a lock that
+// conflicts, unless Options.WaitForLock is set
+var ErrLocked = errors.New("database is locked by another process")
+
+func (db *MMapStorage) lock() error {
+	how := unix.LOCK_EX
+	if db.Options.ReadOnly {
+		how = unix.LOCK_SH
+	}
+	if !db.Options.WaitForLock {
+		how |= unix.LOCK_NB
+	}
+	for {
+		err := unix.Flock(db.fd, how)
+		switch {
+		case err == nil:
+			// a compaction renames its copy over the file this waited for,
+			// the lock is only good for the file at the path
+			replaced, err := db.replaced()
+			if err != nil || !replaced {
+				return err
+			}
+			if err := db.reopen(); err != nil {
+				return err
+			}
+		case errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.EWOULDBLOCK):
+			return fmt.Errorf("%s: %w", db.Path, ErrLocked)
+		default:
+			return fmt.Errorf("lock file: %w", err)
+		}
+	}
+}
+
+// replaced reports if the file at the path is another one than the open one
+func (db *MMapStorage) replaced() (bool, error) {
+	if db.inMemory() {
+		return false, nil
+	}
+	open, err := db.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat file: %w", err)
+	}
+	current, err := os.Stat(db.Path)
+	if err != nil {
+		return false, fmt.Errorf("stat file: %w", err)
+	}
+	return !os.SameFile(open, current), nil
+}
+
+// reopen opens the file at the path again
+func (db *MMapStorage) reopen() error {
+	db.file.Close()
+	f, err := db.openFile()
+	if err != nil {
+		db.file = nil
+		return err
+	}
+	db.file, db.fd = f, int(f.Fd())
+	return nil
+}
@@ -0,0 +1,14 @@
+package storage
+
+// A storage opened with Options.InMemory keeps its pages in an anonymous memory file. It
+// is read, written and committed like a file on disk, the syncs just return
+// right away. It has no log, the pages are gone once it is closed.
+
+// NewMemKV returns a database in memory
+func NewMemKV() (*KV, error) {
+	return NewKVWithOptions("", Options{InMemory: true})
+}
+
+func (db *MMapStorage) inMemory() bool {
+	return db.Options.InMemory
+}
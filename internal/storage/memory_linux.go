@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func openMemory() (*os.File, error) {
+	fd, err := unix.MemfdCreate("database", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("create memory file: %w", err)
+	}
+	return os.NewFile(uintptr(fd), "memory"), nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// openMemory falls back to a temporary file that is removed right away, it
+// lives in the page cache until it is closed
+func openMemory() (*os.File, error) {
+	f, err := os.CreateTemp("", "database-*")
+	if err != nil {
+		return nil, fmt.Errorf("create memory file: %w", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("remove memory file: %w", err)
+	}
+	return f, nil
+}
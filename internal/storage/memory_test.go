@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMemKV(t *testing.T) {
+	// no file may show up in the working directory
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	db, err := NewMemKV()
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	other, err := NewMemKV()
+	if err != nil {
+		t.Fatalf("failed to open second database: %v", err)
+	}
+	defer other.Close()
+
+	batch := WriteBatch{}
+	for i := range 2000 {
+		batch.Put([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	batch.Put([]byte("large"), make([]byte, 3*BTREE_PAGE_SIZE))
+	if err := db.Write(&batch); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	snap := db.Snapshot()
+	defer snap.Close()
+	batch = WriteBatch{}
+	for i := range 2000 {
+		if i%2 == 0 {
+			batch.Delete([]byte(fmt.Sprintf("key-%06d", i)))
+		}
+	}
+	if err := db.Write(&batch); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, found, _ := snap.Get([]byte("key-000000")); !found {
+		t.Fatalf("snapshot should still see the deleted key")
+	}
+	if _, found, _ := db.Get([]byte("key-000000")); found {
+		t.Fatalf("key should be deleted")
+	}
+	if _, found, _ := other.Get([]byte("key-000001")); found {
+		t.Fatalf("databases in memory should not share pages")
+	}
+
+	// a failed batch leaves the last commit as it was
+	batch = WriteBatch{}
+	batch.Put([]byte("new"), []byte("value"))
+	batch.Put(make([]byte, BTREE_PAGE_SIZE), []byte("value"))
+	if err := db.Write(&batch); err == nil {
+		t.Fatalf("write with a too large key should fail")
+	}
+	if _, found, _ := db.Get([]byte("new")); found {
+		t.Fatalf("failed batch should not be visible")
+	}
+
+	snap.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	for i := range 2000 {
+		_, found, err := db.Get([]byte(fmt.Sprintf("key-%06d", i)))
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		if found != (i%2 == 1) {
+			t.Fatalf("key %d should be found: %v, got: %v", i, i%2 == 1, found)
+		}
+	}
+	val, found, err := db.Get([]byte("large"))
+	if err != nil || !found || len(val) != 3*BTREE_PAGE_SIZE {
+		t.Fatalf("large value should survive compaction: %d %v %v", len(val), found, err)
+	}
+	if err := db.Check().Err(); err != nil {
+		t.Fatalf("check should not find problems: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("database in memory should not create files, got: %v", entries)
+	}
+}
+
+func TestKVEmptyPath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if db, err := NewKV(""); err == nil {
+		db.Close()
+		t.Fatalf("empty path should fail instead of opening a database in memory")
+	}
+	if db, err := NewKVWithOptions("db", Options{InMemory: true}); err == nil {
+		db.Close()
+		t.Fatalf("database in memory with a path should fail")
+	}
+}
@@ -1,6 +1,42 @@
 package storage
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// The meta page holds two slots that are written in turns, so a torn write
+// can only destroy the slot of the commit in progress. Open uses the newest
+// slot with a valid checksum. Each slot sits in its own 512 byte sector.
+
+// Meta slot format
+// | sig | root | flushed | free list | flags | page_size | commit | checksum |
+// | 16B | 8B   | 8B      | 4 × 8B    | 8B    | 8B        | 8B     | 4B       |
+//
+// Encrypted, compressed or versioned files follow with, see encrypt.go and
+// compress.go
+// | salt | key check | codec |
+// | 16B  | 16B       | 8B    |
+//
+// The checksum only covers them in those files.
+
+const META_SLOT_SIZE = 512
+
+// Format flags recorded in the meta page of a file
+const (
+	FORMAT_PREFIX_LEAVES  uint64 = 1 << 0 // leaves store the shared key prefix once
+	FORMAT_PAGE_CHECKSUMS uint64 = 1 << 1 // pages start with a checksum, see checksum.go
+	FORMAT_META_SLOTS     uint64 = 1 << 2 // the meta page has two checksummed slots
+	FORMAT_ENCRYPTED      uint64 = 1 << 3 // pages are encrypted, see encrypt.go
+	FORMAT_COMPRESSED     uint64 = 1 << 4 // pages are compressed, see compress.go
+	FORMAT_PAGE_VERSIONS  uint64 = 1 << 5 // pages record the commit that wrote them, see backup.go
+
+	FORMAT_KNOWN = FORMAT_PREFIX_LEAVES | FORMAT_PAGE_CHECKSUMS | FORMAT_META_SLOTS | FORMAT_ENCRYPTED | FORMAT_COMPRESSED | FORMAT_PAGE_VERSIONS
+
+	// flags of files with the fields after the checksum
+	FORMAT_EXTENDED = FORMAT_ENCRYPTED | FORMAT_COMPRESSED | FORMAT_PAGE_VERSIONS
+)
 
 type Metadata struct {
 	Root    uint64
@@ -10,6 +46,19 @@ type Metadata struct {
 	HeadSeq  uint64 // monotonic sequence number to index into the list head
 	TailPage uint64
 	TailSeq  uint64
+
+	Flags uint64 // FORMAT_* flags, 0 for files written before they existed
+
+	PageSize uint64 // size of every page of the file, including the meta page
+
+	// Commit is incremented by every commit, pages record the one that wrote
+	// them. Its parity selects the slot a meta is written to.
+	Commit uint64
+
+	Salt     [16]byte // random per file, the page key is derived from it
+	KeyCheck [16]byte // derived from the key as well, to detect a wrong one
+
+	Codec Codec // compression of the pages if FORMAT_COMPRESSED is set
 }
 
 func NewMetadata(d []byte) *Metadata {
@@ -22,12 +71,25 @@ func NewMetadata(d []byte) *Metadata {
 
 		TailPage: binary.LittleEndian.Uint64(d[48:56]),
 		TailSeq:  binary.LittleEndian.Uint64(d[56:64]),
+
+		Flags: binary.LittleEndian.Uint64(d[64:72]),
+
+		PageSize: binary.LittleEndian.Uint64(d[72:80]),
+
+		Commit: binary.LittleEndian.Uint64(d[80:88]),
+	}
+	copy(metadata.Salt[:], d[92:108])
+	copy(metadata.KeyCheck[:], d[108:124])
+	metadata.Codec = Codec(binary.LittleEndian.Uint64(d[124:132]))
+	if metadata.PageSize == 0 {
+		// files written before the page size was configurable
+		metadata.PageSize = BTREE_PAGE_SIZE
 	}
 	return metadata
 }
 
 func (data Metadata) Save() []byte {
-	var d [4096]byte
+	d := make([]byte, META_SIZE)
 
 	copy(d[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(d[16:24], data.Root)
@@ -37,6 +99,55 @@ func (data Metadata) Save() []byte {
 
 	binary.LittleEndian.PutUint64(d[48:56], data.TailPage)
 	binary.LittleEndian.PutUint64(d[56:64], data.TailSeq)
-	return d[:]
 
+	binary.LittleEndian.PutUint64(d[64:72], data.Flags)
+	binary.LittleEndian.PutUint64(d[72:80], data.PageSize)
+	binary.LittleEndian.PutUint64(d[80:88], data.Commit)
+	copy(d[92:108], data.Salt[:])
+	copy(d[108:124], data.KeyCheck[:])
+	binary.LittleEndian.PutUint64(d[124:132], uint64(data.Codec))
+	binary.LittleEndian.PutUint32(d[88:92], metaChecksum(d, data.Flags))
+	return d
+
+}
+
+// metaChecksum is the checksum of a saved slot, the fields after it only
+// count in files with one of the FORMAT_EXTENDED flags
+func metaChecksum(d []byte, flags uint64) uint32 {
+	sum := crc32.Checksum(d[:88], castagnoli)
+	if flags&FORMAT_EXTENDED != 0 {
+		sum = crc32.Update(sum, castagnoli, d[92:META_SIZE])
+	}
+	return sum
+}
+
+// SlotOffset is where in the meta page the slot of this commit is written
+func (data Metadata) SlotOffset() int64 {
+	return int64(data.Commit%2) * META_SLOT_SIZE
+}
+
+// LoadMetadata returns the newest valid slot of a meta page
+func LoadMetadata(page []byte) (*Metadata, error) {
+	var newest *Metadata
+	for offset := 0; offset < 2*META_SLOT_SIZE; offset += META_SLOT_SIZE {
+		d := page[offset:][:META_SIZE]
+		if string(d[:len(DB_SIG)]) != DB_SIG {
+			continue
+		}
+		metadata := NewMetadata(d)
+		if binary.LittleEndian.Uint32(d[88:92]) != metaChecksum(d, metadata.Flags) {
+			// files written before the slots only have the first one and
+			// no checksum, everything else is a torn write
+			if offset != 0 || metadata.Flags&FORMAT_META_SLOTS != 0 {
+				continue
+			}
+		}
+		if newest == nil || metadata.Commit > newest.Commit {
+			newest = metadata
+		}
+	}
+	if newest == nil {
+		return nil, errors.New("bad meta signature")
+	}
+	return newest, nil
 }
@@ -21,3 +21,61 @@ func TestMetadata_Save(t *testing.T) {
 		t.Fatal("wrong flushed")
 	}
 }
+
+func TestMetadata_PageSize(t *testing.T) {
+	data := NewMetadata(make([]byte, META_SIZE))
+	if data.PageSize != BTREE_PAGE_SIZE {
+		t.Fatalf("files without a page size use the default, got: %d", data.PageSize)
+	}
+
+	data.PageSize = 16384
+	if NewMetadata(data.Save()).PageSize != 16384 {
+		t.Fatal("wrong page size")
+	}
+}
+
+func TestLoadMetadataPicksNewestSlot(t *testing.T) {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	data := NewMetadata(page)
+	for commit := uint64(1); commit <= 3; commit++ {
+		data.Commit = commit
+		data.Root = 10 * commit
+		copy(page[data.SlotOffset():], data.Save())
+	}
+
+	loaded, err := LoadMetadata(page)
+	if err != nil || loaded.Root != 30 {
+		t.Fatalf("should load commit 3, got: %+v, %v", loaded, err)
+	}
+
+	// a torn write of commit 3 falls back to commit 2
+	page[data.SlotOffset()+20] ^= 0xff
+	loaded, err = LoadMetadata(page)
+	if err != nil || loaded.Root != 20 {
+		t.Fatalf("should load commit 2, got: %+v, %v", loaded, err)
+	}
+
+	clear(page)
+	if _, err := LoadMetadata(page); err == nil {
+		t.Fatal("should fail without any valid slot")
+	}
+}
+
+func TestLoadMetadataWithoutSlots(t *testing.T) {
+	// meta pages before the slots had no checksum
+	page := make([]byte, BTREE_PAGE_SIZE)
+	data := NewMetadata(page)
+	data.Root = 5
+	copy(page, data.Save()[:80])
+
+	loaded, err := LoadMetadata(page)
+	if err != nil || loaded.Root != 5 {
+		t.Fatalf("should load the old meta, got: %+v, %v", loaded, err)
+	}
+
+	data.Flags = FORMAT_META_SLOTS
+	copy(page, data.Save()[:80])
+	if _, err := LoadMetadata(page); err == nil {
+		t.Fatal("slots without checksum should be rejected")
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Values larger than BTREE_MAX_VAL_SIZE are stored in a chain of overflow
+// pages. The leaf keeps the first page of the chain in the pointer of the key
+// and the total size of the value instead of the value itself.
+
+// Overflow page format
+// | type | size | next | data   |
+// | 2B   | 2B   | 8B   | size B |
+
+const OVERFLOW_HEADER = 12
+
+func (node BNode) overflowNext() uint64 {
+	return binary.LittleEndian.Uint64(node[4:12])
+}
+
+func (node BNode) overflowData() []byte {
+	return node[OVERFLOW_HEADER:][:node.Keys()]
+}
+
+// writeOverflow stores val in a chain of overflow pages and returns the
+// first page of the chain
+func writeOverflow(val []byte, storage Storage) (uint64, error) {
+	// Write back to front so every page knows its successor
+	pageSize := storage.PageSize()
+	capacity := pageSize - OVERFLOW_HEADER
+	next := uint64(0)
+	end := len(val)
+	for end > 0 {
+		start := (end - 1) / capacity * capacity
+		page := BNode(make([]byte, pageSize))
+		page.setHeader(BNODE_OVERFLOW, uint16(end-start))
+		binary.LittleEndian.PutUint64(page[4:12], next)
+		copy(page[OVERFLOW_HEADER:], val[start:end])
+
+		ptr, err := storage.New(page)
+		if err != nil {
+			// the pages written so far are not referenced by anything
+			return 0, errors.Join(err, freeOverflow(next, storage))
+		}
+		next = ptr
+		end = start
+	}
+	return next, nil
+}
+
+// readOverflow reads a value of the given size back from its chain
+func readOverflow(ptr uint64, size uint64, storage Storage) ([]byte, error) {
+	val := make([]byte, 0, size)
+	for ptr != 0 {
+		data, err := storage.Get(ptr)
+		if err != nil {
+			return nil, err
+		}
+		page := BNode(data)
+		if page.Type() != BNODE_OVERFLOW {
+			return nil, fmt.Errorf("page %d is not an overflow page", ptr)
+		}
+		val = append(val, page.overflowData()...)
+		ptr = page.overflowNext()
+	}
+	if uint64(len(val)) != size {
+		return nil, fmt.Errorf("overflow chain has %d bytes, want %d", len(val), size)
+	}
+	return val, nil
+}
+
+// freeOverflow releases all pages of a chain
+func freeOverflow(ptr uint64, storage Storage) error {
+	for ptr != 0 {
+		data, err := storage.Get(ptr)
+		if err != nil {
+			return err
+		}
+		next := BNode(data).overflowNext()
+		if err := storage.Delete(ptr); err != nil {
+			return err
+		}
+		ptr = next
+	}
+	return nil
+}
+
+// leafValue returns the value at idx of a leaf, following the overflow
+// chain if the value is not stored inline
+func (node BNode) leafValue(idx uint16, storage Storage) ([]byte, error) {
+	val, err := node.getVal(idx)
+	if err != nil {
+		return nil, err
+	}
+	ptr, err := node.getPtr(idx)
+	if err != nil {
+		return nil, err
+	}
+	if ptr == 0 {
+		return val, nil
+	}
+	return readOverflow(ptr, binary.LittleEndian.Uint64(val), storage)
+}
+
+// freeLeafValue releases the overflow chain of the value at idx, if any
+func (node BNode) freeLeafValue(idx uint16, storage Storage) error {
+	ptr, err := node.getPtr(idx)
+	if err != nil {
+		return err
+	}
+	return freeOverflow(ptr, storage)
+}
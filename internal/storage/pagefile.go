@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Committed pages are read through a pageFile. BACKEND_MMAP maps the file in
+// growing chunks, a read is a memory access and the kernel decides what stays
+// in memory. BACKEND_PREAD copies pages into a cache of bounded size, an I/O
+// error is returned by the read instead of arriving as SIGBUS.
+
+type Backend int
+
+const (
+	BACKEND_MMAP Backend = iota
+	BACKEND_PREAD
+)
+
+const DEFAULT_CACHE_SIZE = 8 << 20
+
+type pageFile interface {
+	// read returns size bytes at offset, they must not be changed
+	read(offset int64, size int) ([]byte, error)
+	// extend makes the first size bytes of the file readable
+	extend(size int) error
+	// written drops what is cached of the page at offset after it was
+	// written to the file
+	written(offset int64)
+	// verified reports if the checksum of data read at offset was checked,
+	// verify records that it was. Like written they are called under
+	// MMapStorage.mu, read or write.
+	verified(offset int64, data []byte) bool
+	verify(offset int64, data []byte)
+	stats() CacheStats
+	close() error
+}
+
+// CacheStats counts the reads of the page cache, they are zero for
+// BACKEND_MMAP
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int // pages in the cache
+	Bytes     int
+}
+
+func (db *MMapStorage) openPages() pageFile {
+	if db.Options.Backend == BACKEND_PREAD {
+		limit := db.Options.CacheSize
+		if limit == 0 {
+			limit = DEFAULT_CACHE_SIZE
+		}
+		return newPreadFile(db.file, limit)
+	}
+	return &mmapFile{fd: db.fd}
+}
+
+// extendFile makes the pages up to size bytes readable
+func (db *MMapStorage) extendFile(size int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.pages.extend(size)
+}
+
+// CacheStats returns the statistics of the page cache
+func (kv *KV) CacheStats() CacheStats {
+	kv.storage.mu.RLock()
+	defer kv.storage.mu.RUnlock()
+	return kv.storage.pages.stats()
+}
+
+type mmapFile struct {
+	fd     int
+	total  int         // total mmap'd bytes
+	chunks []mmapChunk // mmap chunks
+}
+
+// mmapChunk is a mapped part of the file, checked has a bit for each
+// BTREE_PAGE_SIZE of data that is set once the page there was verified.
+// Readers set bits in parallel, so they are atomic.
+type mmapChunk struct {
+	data    []byte
+	checked []atomic.Uint64
+}
+
+func (m *mmapFile) read(offset int64, size int) ([]byte, error) {
+	chunk, start := m.chunk(offset, size)
+	if chunk == nil {
+		return nil, fmt.Errorf("bad ptr")
+	}
+	return chunk.data[offset-start:][:size], nil
+}
+
+// chunk returns the chunk that holds size bytes at offset and where it
+// starts in the file
+func (m *mmapFile) chunk(offset int64, size int) (*mmapChunk, int64) {
+	start := int64(0)
+	for i := range m.chunks {
+		end := start + int64(len(m.chunks[i].data))
+		if offset+int64(size) <= end {
+			return &m.chunks[i], start
+		}
+		start = end
+	}
+	return nil, 0
+}
+
+// checkedBit returns the word and mask of the bit of the page at offset,
+// the word is nil if the page is not mapped yet
+func (m *mmapFile) checkedBit(offset int64) (*atomic.Uint64, uint64) {
+	chunk, start := m.chunk(offset, BTREE_PAGE_SIZE)
+	if chunk == nil {
+		return nil, 0
+	}
+	bit := (offset - start) / BTREE_PAGE_SIZE
+	return &chunk.checked[bit/64], 1 << (bit % 64)
+}
+
+func (m *mmapFile) extend(size int) error {
+	if size <= m.total {
+		return nil // enough range
+	}
+
+	// Start with 1MB, double as needed
+	alloc := INITIAL_MMAP_MB << 20 // 1MB
+	if m.total > 0 {
+		alloc = m.total
+	}
+
+	for m.total+alloc < size {
+		alloc *= 2
+	}
+
+	chunk, err := unix.Mmap(
+		m.fd, int64(m.total), alloc,
+		unix.PROT_READ, unix.MAP_SHARED,
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	m.total += alloc
+	m.chunks = append(m.chunks, mmapChunk{
+		data:    chunk,
+		checked: make([]atomic.Uint64, (alloc/BTREE_PAGE_SIZE+63)/64),
+	})
+	return nil
+}
+
+// written implements pageFile, the mapping shows what was written and it
+// needs no check. Pages beyond the mapping are checked once when read.
+func (m *mmapFile) written(offset int64) {
+	m.verify(offset, nil)
+}
+
+// verified implements pageFile, a page stays mapped once it was checked
+func (m *mmapFile) verified(offset int64, _ []byte) bool {
+	word, mask := m.checkedBit(offset)
+	return word != nil && word.Load()&mask != 0
+}
+
+func (m *mmapFile) verify(offset int64, _ []byte) {
+	if word, mask := m.checkedBit(offset); word != nil {
+		word.Or(mask)
+	}
+}
+
+func (m *mmapFile) stats() CacheStats {
+	return CacheStats{}
+}
+
+func (m *mmapFile) close() error {
+	for _, chunk := range m.chunks {
+		if err := unix.Munmap(chunk.data); err != nil {
+			return fmt.Errorf("munmap: %w", err)
+		}
+	}
+	m.chunks = nil
+	return nil
+}
+
+// preadFile keeps the most recently read pages, the least recently used
+// one is dropped once the cache is full. Readers run in parallel, so it has
+// its own lock.
+type preadFile struct {
+	file  *os.File
+	limit int // bytes
+
+	mu    sync.Mutex
+	lru   *list.List // of *cachedPage, most recently used first
+	pages map[int64]*list.Element
+	size  int
+	count CacheStats
+}
+
+type cachedPage struct {
+	offset   int64
+	data     []byte
+	verified bool // dropped with the page, a page read again is checked again
+}
+
+func newPreadFile(file *os.File, limit int) *preadFile {
+	return &preadFile{
+		file:  file,
+		limit: limit,
+		lru:   list.New(),
+		pages: map[int64]*list.Element{},
+	}
+}
+
+func (p *preadFile) read(offset int64, size int) ([]byte, error) {
+	p.mu.Lock()
+	if elem, ok := p.pages[offset]; ok {
+		p.lru.MoveToFront(elem)
+		p.count.Hits++
+		data := elem.Value.(*cachedPage).data
+		p.mu.Unlock()
+		return data, nil
+	}
+	p.count.Misses++
+	p.mu.Unlock()
+
+	// other readers go on while this one waits for the disk
+	data := make([]byte, size)
+	if _, err := p.file.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("pread page at %d: %w", offset, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pages[offset]; !ok {
+		p.pages[offset] = p.lru.PushFront(&cachedPage{offset: offset, data: data})
+		p.size += size
+		for p.size > p.limit && p.lru.Len() > 1 {
+			p.remove(p.lru.Back())
+			p.count.Evictions++
+		}
+	}
+	return data, nil
+}
+
+func (p *preadFile) remove(elem *list.Element) {
+	page := p.lru.Remove(elem).(*cachedPage)
+	delete(p.pages, page.offset)
+	p.size -= len(page.data)
+}
+
+// extend implements pageFile, pread reads any part of the file
+func (p *preadFile) extend(int) error {
+	return nil
+}
+
+func (p *preadFile) written(offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.pages[offset]; ok {
+		p.remove(elem)
+	}
+}
+
+// verified implements pageFile, data is only verified while it is the cached
+// copy of the page
+func (p *preadFile) verified(offset int64, data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	page := p.cached(offset, data)
+	return page != nil && page.verified
+}
+
+func (p *preadFile) verify(offset int64, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if page := p.cached(offset, data); page != nil {
+		page.verified = true
+	}
+}
+
+// cached returns the cache entry of offset if it holds data
+func (p *preadFile) cached(offset int64, data []byte) *cachedPage {
+	elem, ok := p.pages[offset]
+	if !ok {
+		return nil
+	}
+	page := elem.Value.(*cachedPage)
+	if len(data) == 0 || &page.data[0] != &data[0] {
+		return nil
+	}
+	return page
+}
+
+func (p *preadFile) stats() CacheStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.count
+	stats.Pages = p.lru.Len()
+	stats.Bytes = p.size
+	return stats
+}
+
+// close implements pageFile, the file belongs to the storage
+func (p *preadFile) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lru.Init()
+	clear(p.pages)
+	p.size = 0
+	return nil
+}
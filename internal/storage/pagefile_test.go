@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreadFileCache(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer f.Close()
+	for i := range 8 {
+		if _, err := f.Write(bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	cache := newPreadFile(f, 300)
+	read := func(i int) []byte {
+		data, err := cache.read(int64(100*i), 100)
+		if err != nil {
+			t.Fatalf("failed to read page %d: %v", i, err)
+		}
+		return data
+	}
+	for _, i := range []int{0, 1, 2, 0, 3} {
+		if data := read(i); data[0] != byte(i) || len(data) != 100 {
+			t.Fatalf("should read page %d, got: %v", i, data[:1])
+		}
+	}
+	// 1 was used least recently and made room for 3
+	if stats := cache.stats(); stats != (CacheStats{Hits: 1, Misses: 4, Evictions: 1, Pages: 3, Bytes: 300}) {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	read(0)
+	read(2)
+	if stats := cache.stats(); stats.Hits != 3 || stats.Misses != 4 {
+		t.Fatalf("0 and 2 should be cached: %+v", stats)
+	}
+
+	// a written page is read again
+	if _, err := f.WriteAt(bytes.Repeat([]byte{9}, 100), 0); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	cache.written(0)
+	if data := read(0); data[0] != 9 {
+		t.Fatalf("should read the new page, got: %v", data[:1])
+	}
+
+	if _, err := cache.read(800, 100); err == nil {
+		t.Fatal("should fail to read past the end")
+	}
+}
+
+func TestKVPread(t *testing.T) {
+	for _, opts := range []Options{
+		{Backend: BACKEND_PREAD, CacheSize: 64 << 10},
+		{Backend: BACKEND_PREAD, CacheSize: 64 << 10, WAL: true, CheckpointSize: 64 << 10},
+	} {
+		t.Run(fmt.Sprintf("wal=%v", opts.WAL), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			for i := range 5000 {
+				if err := db.Insert([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			for i := 0; i < 5000; i += 2 {
+				if err := db.Delete([]byte(fmt.Sprintf("key-%06d", i))); err != nil {
+					t.Fatalf("failed to delete: %v", err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("failed to close database: %v", err)
+			}
+
+			db, err = NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to reopen database: %v", err)
+			}
+			defer db.Close()
+			for i := range 5000 {
+				val, ok, err := db.Get([]byte(fmt.Sprintf("key-%06d", i)))
+				if err != nil || ok != (i%2 == 1) {
+					t.Fatalf("wrong result for key %d: ok=%v, err=%v", i, ok, err)
+				}
+				if ok && string(val) != fmt.Sprintf("value%d", i) {
+					t.Fatalf("wrong value for key %d: %s", i, val)
+				}
+			}
+			if err := db.Check().Err(); err != nil {
+				t.Fatalf("should not find problems: %v", err)
+			}
+
+			stats := db.CacheStats()
+			if stats.Hits == 0 || stats.Misses == 0 || stats.Evictions == 0 {
+				t.Fatalf("should use the cache: %+v", stats)
+			}
+			if stats.Bytes > opts.CacheSize {
+				t.Fatalf("cache should stay below %d bytes: %+v", opts.CacheSize, stats)
+			}
+		})
+	}
+}
+
+func TestKVPreadVerifiesEvictedPages(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewKVWithOptions(dbPath, Options{Backend: BACKEND_PREAD, CacheSize: BTREE_PAGE_SIZE})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Insert([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if _, _, err := db.Get([]byte("key1")); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	root := db.storage.Metadata.Root
+
+	// another page takes the only place in the cache
+	other := uint64(1)
+	if other == root {
+		other = 2
+	}
+	if _, err := db.storage.pages.read(int64(other*BTREE_PAGE_SIZE), BTREE_PAGE_SIZE); err != nil {
+		t.Fatalf("failed to read page %d: %v", other, err)
+	}
+
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(root*BTREE_PAGE_SIZE)+10); err != nil {
+		t.Fatalf("failed to corrupt page: %v", err)
+	}
+	f.Close()
+
+	_, _, err = db.Get([]byte("key1"))
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) || corrupt.Page != root {
+		t.Fatalf("page %d read again should be checked again, got: %v", root, err)
+	}
+}
+
+func TestMmapFileChecked(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "pages"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(4 * BTREE_PAGE_SIZE); err != nil {
+		t.Fatalf("failed to grow file: %v", err)
+	}
+
+	pages := &mmapFile{fd: int(f.Fd())}
+	defer pages.close()
+	if err := pages.extend(4 * BTREE_PAGE_SIZE); err != nil {
+		t.Fatalf("failed to map file: %v", err)
+	}
+	pages.verify(BTREE_PAGE_SIZE, nil)
+	pages.written(3 * BTREE_PAGE_SIZE)
+	for i, want := range []bool{false, true, false, true} {
+		if got := pages.verified(int64(i*BTREE_PAGE_SIZE), nil); got != want {
+			t.Fatalf("page %d should be verified %v, got: %v", i, want, got)
+		}
+	}
+
+	// a page beyond the mapping is not recorded
+	offset := int64(pages.total)
+	pages.verify(offset, nil)
+	if pages.verified(offset, nil) {
+		t.Fatal("unmapped page should not be verified")
+	}
+
+	// the bitmap covers the mapping, one bit per smallest page
+	if got, want := len(pages.chunks[0].checked)*64, pages.total/BTREE_PAGE_SIZE; got != want {
+		t.Fatalf("bitmap should have %d bits, got: %d", want, got)
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import "encoding/binary"
+
+// Leaves of files created with FORMAT_PREFIX_LEAVES store the prefix shared
+// by all their keys once and only the remaining suffix per key. They have no
+// pointer array, a value in overflow pages is marked in its size instead.
+
+// Prefixed leaf format
+// | type | nkeys | prefix_size | prefix | offsets    | key-values | unused |
+// | 2B   | 2B    | 2B          | ...    | nkeys × 2B | ...        |        |
+
+// Key Values format
+// | suffix_size | val_size | suffix | val |
+// | 2B          | 2B       | ...    | ... |
+
+// Values in overflow pages have VAL_OVERFLOW set in val_size and store
+// | size | first_page |
+// | 8B   | 8B         |
+
+const BNODE_PREFIXED = 0x100 // type flag of leaves in the prefixed format
+const VAL_OVERFLOW = 0x8000
+
+func (node BNode) prefixed() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIXED != 0
+}
+
+func (node BNode) prefixLen() uint16 {
+	return binary.LittleEndian.Uint16(node[4:6])
+}
+
+func (node BNode) prefix() []byte {
+	return node[HEADER+2:][:node.prefixLen()]
+}
+
+// setPrefix switches a node to the prefixed format, it must be called right
+// after setHeader before any key is appended
+func (node BNode) setPrefix(prefix []byte) {
+	btype := binary.LittleEndian.Uint16(node[0:2])
+	binary.LittleEndian.PutUint16(node[0:2], btype|BNODE_PREFIXED)
+	binary.LittleEndian.PutUint16(node[4:6], uint16(len(prefix)))
+	copy(node[HEADER+2:], prefix)
+}
+
+func (node BNode) prefixedPtr(idx uint16) (uint64, error) {
+	pos, err := node.keyValuePosition(idx)
+	if err != nil {
+		return 0, err
+	}
+	klen := binary.LittleEndian.Uint16(node[pos+0:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	if vlen&VAL_OVERFLOW == 0 {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint64(node[pos+HEADER+klen+8:]), nil
+}
+
+func (node BNode) appendPrefixedKV(idx uint16, ptr uint64, key []byte, val []byte) error {
+	pos, err := node.keyValuePosition(idx) // uses the offset value of the previous key
+	if err != nil {
+		return err
+	}
+	suffix := key[node.prefixLen():]
+	vlen := uint16(len(val))
+	if ptr != 0 {
+		val = binary.LittleEndian.AppendUint64(append([]byte{}, val...), ptr)
+		vlen = uint16(len(val)) | VAL_OVERFLOW
+	}
+	binary.LittleEndian.PutUint16(node[pos+0:], uint16(len(suffix)))
+	binary.LittleEndian.PutUint16(node[pos+2:], vlen)
+	copy(node[pos+HEADER:], suffix)
+	copy(node[pos+HEADER+uint16(len(suffix)):], val)
+	// update the offset value for the next key
+	return node.setOffset(idx+1, node.getOffset(idx)+HEADER+uint16(len(suffix)+len(val)))
+}
+
+// sharedPrefix returns the prefix of all keys, as they are sorted that is the
+// common prefix of the first and the last one
+func sharedPrefix(entries []entry) []byte {
+	if len(entries) == 0 {
+		return nil
+	}
+	first, last := entries[0].key, entries[len(entries)-1].key
+	n := 0
+	for n < len(first) && n < len(last) && first[n] == last[n] {
+		n++
+	}
+	return first[:n]
+}
+
+func prefixedSize(entries []entry) int {
+	plen := len(sharedPrefix(entries))
+	size := HEADER + 2 + plen
+	for _, e := range entries {
+		size += 2 + HEADER + len(e.key) - plen + len(e.val)
+		if e.ptr != 0 {
+			size += 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// punchHole gives the padding of a page written at offset back to the file
+// system. File systems without holes keep the zeros.
+func (db *MMapStorage) punchHole(offset int64, used, size int) error {
+	err := unix.Fallocate(db.fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset+int64(used), int64(size-used))
+	if err != nil && !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.ENOSYS) {
+		return fmt.Errorf("punch hole: %w", err)
+	}
+	return nil
+}
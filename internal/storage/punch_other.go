@@ -0,0 +1,9 @@
+//go:build !linux
+
+package storage
+
+// punchHole keeps the zeros where holes cannot be punched, compressed pages
+// are still read the same
+func (db *MMapStorage) punchHole(offset int64, used, size int) error {
+	return nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"iter"
+	"slices"
+)
+
+// Snapshot is a read-only view of the keys as of the commit it was taken at.
+// Pages are never changed in place, so the tree of an older root stays intact
+// as long as its pages are not handed out again. While a snapshot is open the
+// free list keeps every page that was freed after it was taken.
+type Snapshot struct {
+	storage *MMapStorage
+	tree    BTree
+	pin     *snapshotPin
+	closed  bool
+}
+
+// snapshotPin counts the open snapshots that were taken while the tail of
+// the free list was at pos. Snapshots of commits that freed no pages share
+// one.
+type snapshotPin struct {
+	pos     listPos
+	refs    int
+	retired *retiredFile // set once a compaction replaced the file
+}
+
+// retiredFile is a file a compaction replaced, it stays open for the
+// snapshots taken before until the last of them is closed
+type retiredFile struct {
+	storage *MMapStorage
+	pins    int
+}
+
+var ErrReadOnly = errors.New("read-only view")
+
+// Snapshot pins the last commit, the snapshot must be closed to let the
+// pages freed since be reused. It is only valid until the KV is closed.
+func (kv *KV) Snapshot() *Snapshot {
+	db := kv.storage
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	meta := db.committed
+	pos := listPos{page: meta.TailPage, seq: meta.TailSeq}
+	if n := len(db.pins); n == 0 || db.pins[n-1].pos != pos {
+		db.pins = append(db.pins, &snapshotPin{pos: pos})
+	}
+	pin := db.pins[len(db.pins)-1]
+	pin.refs++
+	return &Snapshot{
+		storage: db,
+		tree:    BTree{metaData: &meta, storage: readView{db: db, meta: &meta, pin: pin}},
+		pin:     pin,
+	}
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, bool, error) {
+	return s.tree.Get(key)
+}
+
+// Scan iterates the keys from start up to but not including end
+func (s *Snapshot) Scan(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return s.tree.Scan(start, end)
+}
+
+// ScanReverse iterates the keys between lo and hi in descending order
+func (s *Snapshot) ScanReverse(lo, hi Bound) iter.Seq2[[]byte, []byte] {
+	return s.tree.ScanReverse(lo, hi)
+}
+
+// NewScanner returns the scan of the keys from start up to but not
+// including end, it reports read errors
+func (s *Snapshot) NewScanner(start, end []byte) *Scanner {
+	return s.tree.NewScanner(start, end)
+}
+
+// NewReverseScanner returns the scan of the keys between lo and hi in
+// descending order
+func (s *Snapshot) NewReverseScanner(lo, hi Bound) *Scanner {
+	return s.tree.NewReverseScanner(lo, hi)
+}
+
+// NewCursor returns a cursor over the keys of the snapshot, it stays valid
+// while writes go on until the snapshot is closed
+func (s *Snapshot) NewCursor() *Cursor {
+	return s.tree.NewCursor()
+}
+
+// Close releases the snapshot, closing it twice does nothing. Snapshots are
+// taken in commit order, so the oldest pin that is still counted limits the
+// free list.
+func (s *Snapshot) Close() {
+	db := s.storage
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.pin.refs--
+	if retired := s.pin.retired; retired != nil {
+		if s.pin.refs == 0 {
+			db.release(retired)
+		}
+		return
+	}
+	for len(db.pins) > 0 && db.pins[0].refs == 0 {
+		db.pins = db.pins[1:]
+	}
+}
+
+// release closes a retired file once no snapshot reads it anymore
+func (db *MMapStorage) release(retired *retiredFile) {
+	retired.pins--
+	if retired.pins > 0 {
+		return
+	}
+	retired.storage.Close()
+	db.retired = slices.DeleteFunc(db.retired, func(r *retiredFile) bool {
+		return r == retired
+	})
+}
+
+// readView is the storage of a committed tree, it only reads pages that no
+// transaction in progress changes. A locked view is used by readers that
+// hold mu, the view of a snapshot follows its pin to a retired file.
+type readView struct {
+	db     *MMapStorage
+	meta   *Metadata
+	pin    *snapshotPin
+	locked bool
+}
+
+// Get implements Storage.
+func (v readView) Get(ptr uint64) (page []byte, err error) {
+	if v.locked {
+		return v.db.lockedPage(ptr, v.meta)
+	}
+	err = v.read(func(db *MMapStorage) error {
+		page, err = db.lockedPage(ptr, v.meta)
+		return err
+	})
+	return page, err
+}
+
+// read calls fn under mu of the storage that holds the pages of the view
+func (v readView) read(fn func(db *MMapStorage) error) error {
+	db := v.db
+	db.mu.RLock()
+	if v.pin != nil && v.pin.retired != nil {
+		db.mu.RUnlock()
+		db = v.pin.retired.storage
+		db.mu.RLock()
+	}
+	defer db.mu.RUnlock()
+	return fn(db)
+}
+
+// New implements Storage.
+func (v readView) New([]byte) (uint64, error) {
+	return 0, ErrReadOnly
+}
+
+// Delete implements Storage.
+func (v readView) Delete(uint64) error {
+	return ErrReadOnly
+}
+
+// PageSize implements Storage.
+func (v readView) PageSize() int {
+	return int(v.meta.PageSize) - v.meta.pageHeader()
+}
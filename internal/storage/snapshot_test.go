@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVSnapshot(t *testing.T) {
+	for _, opts := range []Options{{}, {WAL: true, CheckpointSize: 64 << 10}} {
+		t.Run(fmt.Sprintf("wal=%v", opts.WAL), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			db, err := NewKVWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			defer db.Close()
+
+			value := func(round, i int) []byte {
+				return []byte(fmt.Sprintf("value-%d-%d", round, i))
+			}
+			write := func(round int) {
+				batch := WriteBatch{}
+				for i := range 500 {
+					key := []byte(fmt.Sprintf("key-%04d", i))
+					if round%2 == 1 && i%2 == 0 {
+						batch.Delete(key)
+					} else {
+						batch.Put(key, value(round, i))
+					}
+				}
+				if err := db.Write(&batch); err != nil {
+					t.Fatalf("failed to write: %v", err)
+				}
+			}
+
+			write(0)
+			snap := db.Snapshot()
+			for round := 1; round <= 21; round++ {
+				write(round)
+			}
+
+			count := 0
+			for k, v := range snap.Scan(nil, nil) {
+				var i int
+				fmt.Sscanf(string(k), "key-%d", &i)
+				if !bytes.Equal(v, value(0, i)) {
+					t.Fatalf("snapshot should see the old value of %s, got: %s", k, v)
+				}
+				count++
+			}
+			if count != 500 {
+				t.Fatalf("got the count wrong should: 500, is: %d", count)
+			}
+			if _, ok, _ := db.Get([]byte("key-0000")); ok {
+				t.Fatal("deleted key should be gone outside of the snapshot")
+			}
+			if val, _, _ := snap.Get([]byte("key-0000")); !bytes.Equal(val, value(0, 0)) {
+				t.Fatalf("snapshot should still have the deleted key, got: %s", val)
+			}
+
+			// the file grew while the snapshot kept pages from reuse, once
+			// it is closed the freed pages are taken again
+			snap.Close()
+			snap.Close()
+			for round := 22; round <= 23; round++ {
+				write(round)
+			}
+			flushed := db.storage.Metadata.Flushed
+			for round := 24; round <= 40; round++ {
+				write(round)
+			}
+			if db.storage.Metadata.Flushed != flushed {
+				t.Fatalf("file should not grow without snapshots: %d -> %d pages", flushed, db.storage.Metadata.Flushed)
+			}
+		})
+	}
+}
+
+// TestKVSnapshotsInOrder closes the older of two snapshots first
+func TestKVSnapshotsInOrder(t *testing.T) {
+	db, err := NewKV(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var snaps []*Snapshot
+	for round := range 3 {
+		for i := range 200 {
+			if err := db.Insert([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprint(round))); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+		snaps = append(snaps, db.Snapshot())
+	}
+	snaps[0].Close()
+	for i := range 200 {
+		if err := db.Insert([]byte(fmt.Sprintf("key-%04d", i)), []byte("new")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	for round, snap := range snaps[1:] {
+		cursor := snap.NewCursor()
+		count := 0
+		for ok := cursor.First(); ok; ok = cursor.Next() {
+			if string(cursor.Value()) != fmt.Sprint(round+1) {
+				t.Fatalf("snapshot %d sees value %s", round+1, cursor.Value())
+			}
+			count++
+		}
+		if cursor.Err() != nil || count != 200 {
+			t.Fatalf("snapshot %d should have 200 keys, has: %d, err: %v", round+1, count, cursor.Err())
+		}
+		snap.Close()
+	}
+}
+
+// TestKVSnapshotPins counts the snapshots of a commit in one pin
+func TestKVSnapshotPins(t *testing.T) {
+	db, err := NewKV(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	for i := range 200 {
+		if err := db.Insert([]byte(fmt.Sprintf("key-%04d", i)), []byte("old")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	first, second := db.Snapshot(), db.Snapshot()
+	if _, _, err := db.Get([]byte("key-0000")); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if len(db.storage.pins) != 1 || db.storage.pins[0].refs != 2 {
+		t.Fatalf("snapshots of one commit should share a pin, got: %d pins", len(db.storage.pins))
+	}
+	for i := range 200 {
+		if err := db.Insert([]byte(fmt.Sprintf("key-%04d", i)), []byte("new")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	third := db.Snapshot()
+	if len(db.storage.pins) != 2 {
+		t.Fatalf("snapshot of a later commit should get its own pin, got: %d pins", len(db.storage.pins))
+	}
+
+	first.Close()
+	first.Close()
+	if len(db.storage.pins) != 2 || db.storage.pins[0].refs != 1 {
+		t.Fatalf("closing a snapshot twice should count once")
+	}
+	second.Close()
+	if len(db.storage.pins) != 1 || db.storage.pins[0] != third.pin {
+		t.Fatalf("pin without snapshots should be dropped")
+	}
+	third.Close()
+	if len(db.storage.pins) != 0 {
+		t.Fatalf("all pins should be dropped, got: %d", len(db.storage.pins))
+	}
+}
+
+func TestKVCursorOutlivesWrites(t *testing.T) {
+	db, err := NewKV(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := range 200 {
+		if err := db.Insert([]byte(fmt.Sprintf("key-%04d", i)), []byte("old")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	cursor := db.NewCursor()
+	if !cursor.First() {
+		t.Fatalf("cursor should be at the first key: %v", cursor.Err())
+	}
+	// the writes would reuse the pages of the cursor if it did not pin them
+	for round := range 5 {
+		for i := range 200 {
+			if err := db.Insert([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprint(round))); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+	}
+	count := 0
+	for ok := true; ok; ok = cursor.Next() {
+		if string(cursor.Value()) != "old" {
+			t.Fatalf("cursor should see the old value of %s, got: %s", cursor.Key(), cursor.Value())
+		}
+		count++
+	}
+	if cursor.Err() != nil || count != 200 {
+		t.Fatalf("cursor should see 200 keys, saw: %d, err: %v", count, cursor.Err())
+	}
+
+	cursor.Close()
+	cursor.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("closed cursor should not hold up compaction: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// MockStorage keeps pages in a map and logs to the test, page ids are
+// counted up from 1
+type MockStorage struct {
+	storage  map[uint64][]byte
+	testing  *testing.T
+	pageSize int // BTREE_PAGE_SIZE if not set
+	last     uint64
+}
+
+func (m *MockStorage) DumpPages() {
+	for k, v := range m.storage {
+		m.testing.Logf("Node hexdump (key: %d):\n%s", k, hex.Dump(v))
+	}
+}
+
+// Delete implements Storage.
+func (m *MockStorage) Delete(i uint64) error {
+	m.testing.Logf("deleting page: %d", i)
+	delete(m.storage, i)
+	return nil
+}
+
+// Get implements Storage.
+func (m *MockStorage) Get(i uint64) ([]byte, error) {
+	return m.storage[i], nil
+}
+
+// New implements Storage.
+func (m *MockStorage) New(d []byte) (uint64, error) {
+	if len(d) > m.PageSize() {
+		m.testing.Logf("Node hexdump:\n%s", hex.Dump(d))
+		m.testing.Errorf("New() called with %d bytes, exceeds the page size (%d)", len(d), m.PageSize())
+	}
+	m.last++
+	idx := m.last
+	node := BNode(d)
+	m.testing.Logf("creating page: %d type: %d", idx, node.Type())
+	m.storage[idx] = d
+	return idx, nil
+}
+
+// PageSize implements Storage.
+func (m *MockStorage) PageSize() int {
+	if m.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return m.pageSize
+}
+
+// Update implements ListStorage.
+func (m *MockStorage) Update(i uint64) ([]byte, error) {
+	return m.storage[i], nil
+}
+
+// Append implements ListStorage.
+func (m *MockStorage) Append(d []byte) (uint64, error) {
+	return m.New(d)
+}
+
+var _ ListStorage = &MockStorage{}
@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// In WAL mode a commit appends the pages it changed and the new meta to a log
+// next to the file and only syncs the log. The pages stay in memory until a
+// checkpoint copies them into the file in the background and writes the meta
+// page. A checkpoint moves the log aside to WAL_OLD_SUFFIX and commits go on
+// in a new one, the old log is removed once the checkpoint is done. Open
+// replays what is left of both logs, the old one first, so the file is back
+// at the last commit even if a checkpoint was torn.
+
+// Log record format
+// | checksum | npages | meta      | ptr | node      | ...
+// | 4B       | 4B     | META_SIZE | 8B  | node size |
+//
+// Encrypted files log their nodes encrypted, ENCRYPTED_OVERHEAD bytes larger.
+// Nodes are logged uncompressed.
+
+// The checksum is a CRC32C of the rest of the record, replay stops at the
+// first record that does not match. That is where a commit was torn.
+
+const (
+	WAL_SUFFIX     = "-wal"
+	WAL_OLD_SUFFIX = "-wal-old"
+)
+const DEFAULT_CHECKPOINT_SIZE = 4 << 20
+
+type wal struct {
+	file    *os.File
+	size    int64             // bytes of log since the last checkpoint started
+	pending map[uint64][]byte // committed pages not copied into the file yet
+
+	running *checkpoint // checkpoint in the background, if any
+	done    chan error
+	failed  error // a checkpoint that could not start, the next commit fails
+}
+
+type checkpoint struct {
+	pages map[uint64][]byte
+	meta  Metadata
+	gen   uint64 // generation of the page writes
+}
+
+func (db *MMapStorage) walPath() string {
+	return db.Path + WAL_SUFFIX
+}
+
+func (db *MMapStorage) oldWALPath() string {
+	return db.Path + WAL_OLD_SUFFIX
+}
+
+// logPageSize is the size of a node in a log record
+func (db *MMapStorage) logPageSize() int {
+	if db.cipher != nil {
+		return db.PageSize() + ENCRYPTED_OVERHEAD
+	}
+	return db.PageSize()
+}
+
+// recoverWAL applies the logs left over from an earlier process and copies
+// them into the file. It runs before the tree is attached, also when the
+// file is opened without WAL mode.
+func (db *MMapStorage) recoverWAL() error {
+	if db.inMemory() {
+		return nil
+	}
+	var meta *Metadata
+	for _, path := range []string{db.oldWALPath(), db.walPath()} {
+		last, err := db.replayLog(path)
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			meta = last
+		}
+	}
+
+	if meta != nil {
+		db.Metadata = meta
+		if err := unix.Fsync(db.fd); err != nil {
+			return fmt.Errorf("fsync pages: %w", err)
+		}
+		if err := db.writeMeta(meta); err != nil {
+			return err
+		}
+		if err := db.extendFile(int(meta.Flushed * meta.PageSize)); err != nil {
+			return err
+		}
+	}
+	for _, path := range []string{db.oldWALPath(), db.walPath()} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove wal: %w", err)
+		}
+	}
+	return nil
+}
+
+// replayLog writes the pages of every complete record of the log at path
+// into the file, one record at a time, and returns the meta of the last one.
+// The meta page is left to the caller, a crash in between replays again.
+func (db *MMapStorage) replayLog(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+	defer f.Close()
+	if db.Options.ReadOnly {
+		return nil, errors.New("wal needs recovery, open the file for writing first")
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat wal: %w", err)
+	}
+
+	var meta *Metadata
+	r := bufio.NewReader(f)
+	size := db.logPageSize()
+	left := stat.Size()
+	for {
+		record, err := db.readRecord(r, left)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return meta, nil // end of the log or a torn commit
+		}
+		left -= int64(len(record))
+
+		npages := int(binary.LittleEndian.Uint32(record[4:8]))
+		meta = NewMetadata(record[8:][:META_SIZE])
+		gen, err := db.nextGeneration()
+		if err != nil {
+			return nil, err
+		}
+		body := record[8+META_SIZE:]
+		for range npages {
+			ptr := binary.LittleEndian.Uint64(body[0:8])
+			page := body[8:][:size]
+			if db.cipher != nil {
+				if page, err = db.cipher.open(ptr, page); err != nil {
+					return nil, fmt.Errorf("wal: %w", err)
+				}
+			}
+			if err := db.writePage(ptr, page, meta, gen); err != nil {
+				return nil, err
+			}
+			body = body[8+size:]
+		}
+	}
+}
+
+// readRecord reads the next record of a log with left bytes to go, it
+// returns nil at the end of the log and at a record that is incomplete or
+// does not match its checksum
+func (db *MMapStorage) readRecord(r io.Reader, left int64) ([]byte, error) {
+	head := make([]byte, 8+META_SIZE)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read wal: %w", err)
+	}
+	npages := int64(binary.LittleEndian.Uint32(head[4:8]))
+	size := int64(len(head)) + npages*int64(8+db.logPageSize())
+	if size > left {
+		return nil, nil
+	}
+	record := make([]byte, size)
+	copy(record, head)
+	if _, err := io.ReadFull(r, record[len(head):]); err != nil {
+		return nil, fmt.Errorf("read wal: %w", err)
+	}
+	if binary.LittleEndian.Uint32(record[0:4]) != crc32.Checksum(record[4:], castagnoli) {
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (db *MMapStorage) openWAL() error {
+	f, err := os.OpenFile(db.walPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	db.wal = &wal{
+		file:    f,
+		pending: map[uint64][]byte{},
+		done:    make(chan error, 1),
+	}
+	return nil
+}
+
+// logCommit commits the transaction by appending it to the log
+func (db *MMapStorage) logCommit() error {
+	if err := db.wal.failed; err != nil {
+		db.wal.failed = nil
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	// a checkpoint that falls behind holds up the commits, so neither log
+	// grows past a few checkpoints
+	behind := db.wal.size >= 4*db.checkpointSize()
+	if err := db.finishCheckpoint(behind); err != nil {
+		return err
+	}
+	gen, err := db.nextGeneration()
+	if err != nil {
+		return err
+	}
+
+	pages := make(map[uint64][]byte, len(db.page.temp)+len(db.page.updates))
+	for i, page := range db.page.temp {
+		pages[db.Metadata.Flushed+uint64(i)] = page
+	}
+	for ptr, page := range db.page.updates {
+		pages[ptr] = page
+	}
+	db.Metadata.Flushed += uint64(len(db.page.temp))
+
+	record := make([]byte, 8, 8+META_SIZE+len(pages)*(8+db.logPageSize()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(pages)))
+	record = append(record, db.Metadata.Save()...)
+	for ptr, page := range pages {
+		record = binary.LittleEndian.AppendUint64(record, ptr)
+		if db.cipher != nil {
+			page = db.cipher.seal(ptr, gen, page)
+		}
+		record = append(record, page...)
+	}
+	binary.LittleEndian.PutUint32(record[0:4], crc32.Checksum(record[4:], castagnoli))
+
+	fd := int(db.wal.file.Fd())
+	if _, err := unix.Pwrite(fd, record, db.wal.size); err != nil {
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err := fdatasync(fd); err != nil {
+		return fmt.Errorf("fsync wal: %w", err)
+	}
+	db.wal.size += int64(len(record))
+
+	db.mu.Lock()
+	for ptr, page := range pages {
+		db.wal.pending[ptr] = page
+	}
+	db.mu.Unlock()
+	db.page.temp = nil
+	clear(db.page.updates)
+	clear(db.page.reused)
+
+	// the commit is durable, an error from here on must not undo it
+	if db.wal.running == nil && db.wal.size >= db.checkpointSize() {
+		db.wal.failed = db.startCheckpoint()
+	}
+	return nil
+}
+
+func (db *MMapStorage) checkpointSize() int64 {
+	if db.Options.CheckpointSize == 0 {
+		return DEFAULT_CHECKPOINT_SIZE
+	}
+	return db.Options.CheckpointSize
+}
+
+// startCheckpoint copies the committed pages into the file in the
+// background. Pages are never changed in place, so the checkpoint can use
+// them while new commits replace them in pending.
+func (db *MMapStorage) startCheckpoint() error {
+	gen, err := db.nextGeneration()
+	if err != nil {
+		return err
+	}
+	if err := db.rotateWAL(); err != nil {
+		return err
+	}
+	cp := &checkpoint{
+		pages: make(map[uint64][]byte, len(db.wal.pending)),
+		meta:  *db.Metadata,
+		gen:   gen,
+	}
+	for ptr, page := range db.wal.pending {
+		cp.pages[ptr] = page
+	}
+	db.wal.running = cp
+	go func() {
+		db.wal.done <- db.writeCheckpoint(cp.pages, &cp.meta, cp.gen)
+	}()
+	return nil
+}
+
+// rotateWAL moves the log aside for a checkpoint, every pending page is in
+// it, and starts a new one. The directory is synced, a commit to the new log
+// must not get lost with its name.
+func (db *MMapStorage) rotateWAL() error {
+	if err := os.Rename(db.walPath(), db.oldWALPath()); err != nil {
+		return fmt.Errorf("rotate wal: %w", err)
+	}
+	f, err := os.OpenFile(db.walPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	if err := syncDir(filepath.Dir(db.Path)); err != nil {
+		f.Close()
+		return err
+	}
+	old := db.wal.file
+	db.wal.file, db.wal.size = f, 0
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("close wal: %w", err)
+	}
+	return nil
+}
+
+// finishCheckpoint drops the pages of a finished checkpoint from memory and
+// removes the log it covered. With wait it blocks until the running
+// checkpoint is done.
+func (db *MMapStorage) finishCheckpoint(wait bool) error {
+	cp := db.wal.running
+	if cp == nil {
+		return nil
+	}
+	var err error
+	if wait {
+		err = <-db.wal.done
+	} else {
+		select {
+		case err = <-db.wal.done:
+		default:
+			return nil
+		}
+	}
+	db.wal.running = nil
+	if err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+
+	if err := db.extendFile(int(cp.meta.Flushed * cp.meta.PageSize)); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	for ptr, page := range cp.pages {
+		if current := db.wal.pending[ptr]; len(current) > 0 && &current[0] == &page[0] {
+			delete(db.wal.pending, ptr)
+		}
+	}
+	db.mu.Unlock()
+
+	// replaying it again would be harmless, so the directory is not synced
+	if err := os.Remove(db.oldWALPath()); err != nil {
+		return fmt.Errorf("remove old wal: %w", err)
+	}
+	return nil
+}
+
+// writeCheckpoint writes pages into the file and then commits meta to the
+// meta page
+func (db *MMapStorage) writeCheckpoint(pages map[uint64][]byte, meta *Metadata, gen uint64) error {
+	for ptr, page := range pages {
+		if err := db.writePage(ptr, page, meta, gen); err != nil {
+			return err
+		}
+	}
+	if err := unix.Fsync(db.fd); err != nil {
+		return fmt.Errorf("fsync pages: %w", err)
+	}
+	return db.writeMeta(meta)
+}
+
+// closeWAL checkpoints everything that is still in the log. The log is
+// closed also when that fails, it is then replayed on the next open.
+func (db *MMapStorage) closeWAL() (err error) {
+	defer func() {
+		if cerr := db.wal.file.Close(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("close wal: %w", cerr))
+		}
+		db.mu.Lock()
+		db.wal = nil
+		db.mu.Unlock()
+	}()
+	if err := db.finishCheckpoint(true); err != nil {
+		return err
+	}
+	if db.wal.size > 0 {
+		if err := db.startCheckpoint(); err != nil {
+			return err
+		}
+		if err := db.finishCheckpoint(true); err != nil {
+			return err
+		}
+	}
+	return os.Remove(db.walPath())
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("fsync dir: %w", err)
+	}
+	return nil
+}